@@ -0,0 +1,75 @@
+package opic
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StartAutosave saves the state every interval in the background, whenever
+// it's changed since the last save, for long running processes that would
+// otherwise need a ticker of their own. Each save uses so, which can be nil.
+// A failed save is retried at the next tick, since the state is still dirty,
+// and its error is kept for AutosaveError. Saves are serialised with each
+// other, so calling Save directly in the meantime is fine. It fails if the
+// interval isn't positive.
+//
+// The returned function stops the autosaving, waits for any save in progress,
+// and then saves one last time if anything has changed, returning the error
+// from that save. Calling it more than once does nothing after the first.
+func (p *Persistent) StartAutosave(interval time.Duration, so *PersistentSaveOptions) (func() error, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("autosave interval must be positive, got %v", interval)
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	t := time.NewTicker(interval)
+
+	go func() {
+		defer close(finished)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if p.Dirty() {
+					err := p.Save(so)
+
+					p.autosaveM.Lock()
+					p.autosaveErr = err
+					p.autosaveM.Unlock()
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	var err error
+
+	return func() error {
+		once.Do(func() {
+			close(done)
+			<-finished
+
+			if p.Dirty() {
+				err = p.Save(so)
+			}
+		})
+
+		return err
+	}, nil
+}
+
+// AutosaveError returns the error from the most recent save made in the
+// background by StartAutosave, or nil if it succeeded or there hasn't been
+// one. It isn't affected by calling Save directly.
+func (p *Persistent) AutosaveError() error {
+	p.autosaveM.Lock()
+	defer p.autosaveM.Unlock()
+
+	return p.autosaveErr
+}
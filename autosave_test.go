@@ -0,0 +1,87 @@
+package opic
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAutosaveInvalidInterval(t *testing.T) {
+	p := NewPersistent(filepath.Join(os.TempDir(), "opic-never-written"))
+
+	if _, err := p.StartAutosave(0, nil); err == nil {
+		t.Errorf("expected an error for a zero interval")
+	}
+}
+
+func TestAutosave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "state.opic")
+
+	p := NewPersistent(filename)
+	p.Initialise(1, []string{"a", "b"})
+
+	stop, err := p.StartAutosave(time.Millisecond, &PersistentSaveOptions{TempPrefix: "autosave"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; p.Dirty() && i < 1000; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := p.AutosaveError(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Distribute("a", []string{"b"}, time.Now())
+
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	q := NewPersistent(filename)
+	if err := q.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.ContentHash() != q.ContentHash() {
+		t.Errorf("the last change wasn't saved when autosaving stopped")
+	}
+}
+
+func TestAutosaveError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the temporary file can't be created in a directory that doesn't exist
+	p := NewPersistent(filepath.Join(dir, "missing", "state.opic"))
+	p.Initialise(1, []string{"a", "b"})
+
+	stop, err := p.StartAutosave(time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; p.AutosaveError() == nil && i < 1000; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	if p.AutosaveError() == nil {
+		t.Errorf("expected the failed save to be reported")
+	}
+
+	if err := stop(); err == nil {
+		t.Errorf("expected the final save to fail too")
+	}
+}
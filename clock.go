@@ -0,0 +1,29 @@
+package opic
+
+import (
+	"time"
+)
+
+// Clock tells the time. Everything an OPIC instance does that needs the
+// current time, and isn't given one explicitly, asks its Clock, so that
+// replaying a recorded crawl or testing can control it.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// SetClock sets the clock used wherever the current time is needed but isn't
+// passed in. A nil clock restores the default, which uses time.Now.
+func (o *OPIC) SetClock(c Clock) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if c == nil {
+		c = realClock{}
+	}
+
+	o.clock = c
+}
@@ -0,0 +1,124 @@
+package opic
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when it's told to, so that tests of
+// anything that asks for the current time are deterministic.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newExpiringTestOPIC makes an instance with a one hour TTL, where a and b
+// were cleared at t0 and c and d an hour and a half later.
+func newExpiringTestOPIC(t0 time.Time) (*OPIC, *fakeClock) {
+	clock := &fakeClock{t: t0}
+
+	o := New()
+	o.SetClock(clock)
+	o.SetTTL(time.Hour)
+	o.Initialise(1, []string{"a", "b", "c", "d"})
+	o.Distribute("a", []string{"b"}, t0)
+	o.Distribute("c", []string{"d"}, t0.Add(time.Minute*90))
+
+	return o, clock
+}
+
+func TestRegisterNClock(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{t: t0}
+
+	o := New()
+	o.SetClock(clock)
+
+	if !o.RegisterN(1) {
+		t.Fatal("expected the entry to be added")
+	}
+	if _, _, ct := o.GetN(1); !ct.Equal(t0) {
+		t.Errorf("expected the entry to be cleared at %v but got %v", t0, ct)
+	}
+
+	clock.Advance(time.Hour)
+
+	if o.RegisterN(1) {
+		t.Errorf("expected registering an existing entry to do nothing")
+	}
+	if _, _, ct := o.GetN(1); !ct.Equal(t0) {
+		t.Errorf("expected the cleared time to stay at %v but got %v", t0, ct)
+	}
+
+	if !o.RegisterN(2) {
+		t.Fatal("expected the entry to be added")
+	}
+	if _, _, ct := o.GetN(2); !ct.Equal(t0.Add(time.Hour)) {
+		t.Errorf("expected the entry to be cleared at %v but got %v", t0.Add(time.Hour), ct)
+	}
+}
+
+func TestTopNClock(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	o, clock := newExpiringTestOPIC(t0)
+
+	clock.Advance(time.Minute * 30)
+	if r := o.TopN(10); len(r) != 4 {
+		t.Errorf("expected all 4 entries before any expired but got %d", len(r))
+	}
+
+	clock.Advance(time.Minute * 90)
+	r := o.TopN(10)
+	if len(r) != 2 {
+		t.Fatalf("expected 2 entries once a and b expired but got %d", len(r))
+	}
+	for _, e := range r {
+		if e.Hash != o.hash("c") && e.Hash != o.hash("d") {
+			t.Errorf("expected only c and d but got %x", e.Hash)
+		}
+	}
+	if r[0].Current < r[1].Current {
+		t.Errorf("expected the entry with the most cash first")
+	}
+}
+
+func TestWeightedSampleClock(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	o, clock := newExpiringTestOPIC(t0)
+
+	rng := rand.New(rand.NewSource(1))
+
+	seen := make(map[uint64]bool)
+	for i := 0; i < 1000; i++ {
+		k, ok := o.WeightedSample(rng)
+		if !ok {
+			t.Fatal("expected an entry to be picked")
+		}
+		seen[k] = true
+	}
+	if len(seen) != 4 {
+		t.Errorf("expected all 4 entries to be picked before any expired but got %d", len(seen))
+	}
+
+	clock.Advance(time.Hour * 2)
+
+	for i := 0; i < 1000; i++ {
+		k, ok := o.WeightedSample(rng)
+		if !ok {
+			t.Fatal("expected an entry to be picked")
+		}
+		if k != o.hash("c") && k != o.hash("d") {
+			t.Fatalf("expected only c and d to be picked once a and b expired but got %x", k)
+		}
+	}
+
+	clock.Advance(time.Hour)
+
+	if _, ok := o.WeightedSample(rng); ok {
+		t.Errorf("expected nothing to be picked once everything expired")
+	}
+}
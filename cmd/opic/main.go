@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"strings"
 	"time"
@@ -14,10 +15,15 @@ import (
 
 var (
 	filename   = flag.String("filename", "opic.db", "File to keep state in.")
+	compress   = flag.Bool("compress", false, "Gzip the state file when saving.")
 	interval   = flag.Duration("interval", time.Hour*24, "Interval for OPIC algorithm.")
 	initialise = flag.Float64("initialise", 1, "Initialise the OPIC state with this global cash.")
 	importFile = flag.String("import", "", "CSV file with URLS to import.")
+	importCash = flag.String("import-cash", "", "CSV file with url,cash rows to import.")
+	export     = flag.String("export", "", "Write the OPIC state to this file as CSV.")
 	stats      = flag.Bool("stats", false, "Show stats about the OPIC state.")
+	top        = flag.Int("top", 10, "Number of entries with the most cash to list in the stats.")
+	trackURLs  = flag.Bool("track-urls", true, "Remember URLs as well as their hashes, so stats and exports can show them.")
 	read       = flag.Bool("read", false, "Read accurate data about the arguments.")
 	estimate   = flag.Bool("estimate", false, "Estimate current cash of the arguments.")
 	distribute = flag.String("distribute", "", "Distribute cash from the URL to the rest of the arguments.")
@@ -37,11 +43,66 @@ func main() {
 	}
 
 	a := opic.NewPersistent(*filename)
-	if err := a.Load(&opic.PersistentLoadOptions{IgnoreMissing: true}); err != nil {
+	if *compress {
+		a = opic.NewPersistentCompressed(*filename)
+	}
+	// URLs are only read from the file if tracking is already on
+	a.SetTrackURLs(*trackURLs)
+	if err := a.Load(&opic.PersistentLoadOptions{IgnoreMissing: true, Exclusive: true}); err != nil {
 		panic(err)
 	}
+	defer a.Close()
 
 	switch {
+	case *stats:
+		st := a.Stats()
+		fmt.Printf("entries\t%v\n", st.Entries)
+		fmt.Printf("history\t%v\n", st.History)
+		fmt.Printf("current\t%v\n", st.Current)
+		fmt.Printf("current_min\t%v\n", st.MinCurrent)
+		fmt.Printf("current_max\t%v\n", st.MaxCurrent)
+		fmt.Printf("current_mean\t%v\n", st.MeanCurrent)
+		fmt.Printf("virtual_history\t%v\n", st.VirtualHistory)
+		fmt.Printf("virtual_current\t%v\n", st.VirtualCurrent)
+		fmt.Printf("virtual_fraction\t%v\n", a.VirtualFraction())
+		fmt.Printf("gini\t%v\n", a.Gini())
+		fmt.Printf("entropy\t%v\n", a.Entropy())
+
+		// decades either side of the mean show how far from even the spread is
+		var buckets []float64
+		for e := -3; e <= 3; e++ {
+			buckets = append(buckets, st.MeanCurrent*math.Pow(10, float64(e)))
+		}
+		for i, n := range a.Histogram(buckets) {
+			if i < len(buckets) {
+				fmt.Printf("histogram_lt_%v\t%d\n", buckets[i], n)
+			} else {
+				fmt.Printf("histogram_ge_%v\t%d\n", buckets[i-1], n)
+			}
+		}
+
+		for _, e := range a.TopN(*top) {
+			u, ok := a.URL(e.Hash)
+			if !ok {
+				u = fmt.Sprintf("%016x", e.Hash)
+			}
+
+			fmt.Printf("top\t%s\t%v\n", u, e.Current)
+		}
+	case *export != "":
+		f, err := os.Create(*export)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+
+		if err := a.ExportCSV(f); err != nil {
+			panic(err)
+		}
+
+		if err := f.Close(); err != nil {
+			panic(err)
+		}
 	case *read:
 		for _, u := range flag.Args() {
 			ah, ac, af := a.Get(u)
@@ -86,12 +147,27 @@ func main() {
 		fmt.Printf("# initialising to %v with %d urls\n", *initialise, len(initialURLs))
 
 		a.Initialise(*initialise, initialURLs)
+	case *importCash != "":
+		fmt.Printf("# importing cash from %s\n", *importCash)
+
+		f, err := os.Open(*importCash)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+
+		n, err := a.ImportCSV(f, nil)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("# imported %d urls\n", n)
 	}
 
 	if a.Dirty() {
 		fmt.Printf("# saving\n")
 
-		if err := a.Save(); err != nil {
+		if err := a.Save(nil); err != nil {
 			panic(err)
 		}
 	}
@@ -0,0 +1,141 @@
+package opic
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// ImportCSVOptions controls how ImportCSV treats its input.
+type ImportCSVOptions struct {
+	// Strict makes ImportCSV fail on a row with a missing or invalid cash
+	// column. Otherwise such rows (including a header row) are skipped.
+	Strict bool
+	// Conserve takes any cash added by the import from the virtual entry,
+	// and returns any cash removed by it, so the system total is unchanged.
+	// This can leave the virtual entry negative if the imported cash exceeds
+	// what it holds.
+	Conserve bool
+}
+
+// ImportCSV reads url,cash rows from r and sets the current cash of each URL
+// directly from them, for seeding from an external prior rather than an even
+// split. Rows are applied as they're read, so the input can be arbitrarily
+// large. It returns the number of rows imported.
+func (o *OPIC) ImportCSV(r io.Reader, opts *ImportCSVOptions) (int, error) {
+	var strict, conserve bool
+	if opts != nil {
+		strict, conserve = opts.Strict, opts.Conserve
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	var n int
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if len(rec) < 2 {
+			if strict {
+				return n, fmt.Errorf("line %d: missing cash column", line)
+			}
+			continue
+		}
+
+		v, err := strconv.ParseFloat(rec[1], 64)
+		if err != nil || !validCash(v) {
+			if strict {
+				return n, fmt.Errorf("line %d: invalid cash %q", line, rec[1])
+			}
+			continue
+		}
+
+		k := o.hash(rec[0])
+
+		o.m.Lock()
+		o.noteURL(k, rec[0])
+		if conserve {
+			o.current[0] = o.current[0] - (v - o.current[k])
+		}
+		o.current[k] = v
+		o.changed()
+		o.m.Unlock()
+
+		n++
+	}
+
+	return n, nil
+}
+
+// ExportCSV writes the state to w as CSV, with a header row followed by one
+// row per entry in key order, not including the virtual entry. The columns
+// are hash, history, current, cleared and interval, with cleared in RFC3339
+// format and empty for entries that have never been fetched, and interval in
+// the format of time.Duration's String method and empty for entries without
+// an interval of their own (see SetIntervalN). If URLs are being tracked
+// (see SetTrackURLs), there's a leading url column, empty where the URL isn't
+// known. The read lock is held while writing. The output isn't in the format
+// read by ImportCSV, which only takes url,cash rows.
+func (o *OPIC) ExportCSV(w io.Writer) error {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	urls := o.urls != nil
+
+	cw := csv.NewWriter(w)
+
+	rec := []string{"hash", "history", "current", "cleared", "interval"}
+	if urls {
+		rec = append([]string{"url"}, rec...)
+	}
+
+	if err := cw.Write(rec); err != nil {
+		return err
+	}
+
+	for _, k := range o.sortedKeys() {
+		if k == 0 {
+			continue
+		}
+
+		rec = rec[:0]
+		if urls {
+			rec = append(rec, o.urls[k])
+		}
+
+		var cleared string
+		if t, ok := o.cleared[k]; ok && !t.IsZero() {
+			cleared = t.Format(time.RFC3339)
+		}
+
+		var interval string
+		if d, ok := o.intervals[k]; ok {
+			interval = d.String()
+		}
+
+		rec = append(rec,
+			strconv.FormatUint(k, 10),
+			strconv.FormatFloat(o.history[k], 'g', -1, 64),
+			strconv.FormatFloat(o.current[k], 'g', -1, 64),
+			cleared,
+			interval,
+		)
+
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
@@ -0,0 +1,68 @@
+package opic
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// EntryDiff is how a single entry differs between two states. See Diff.
+type EntryDiff struct {
+	Hash    uint64
+	Current float64
+	History float64
+	// Interval is the change in the entry's own interval, with a missing
+	// one counting as zero.
+	Interval time.Duration
+}
+
+// Diff compares o to other, e.g. two snapshots of the same crawl, returning
+// the change in current and history cash and in per-entry intervals from
+// other to o for every key in either of them, including the virtual entry. A
+// key missing from one side counts as zero there. The biggest changes in
+// current cash come first, with ties broken by lowest key.
+func (o *OPIC) Diff(other *OPIC) []EntryDiff {
+	other.m.RLock()
+	current := make(map[uint64]float64, len(other.current))
+	for k, v := range other.current {
+		current[k] = v
+	}
+	history := make(map[uint64]float64, len(other.history))
+	for k, v := range other.history {
+		history[k] = v
+	}
+	intervals := make(map[uint64]time.Duration, len(other.intervals))
+	for k, v := range other.intervals {
+		intervals[k] = v
+	}
+	keys := other.sortedKeys()
+	other.m.RUnlock()
+
+	o.m.RLock()
+	seen := make(map[uint64]struct{}, len(keys))
+	for _, k := range keys {
+		seen[k] = struct{}{}
+	}
+	for _, k := range o.sortedKeys() {
+		if _, ok := seen[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+
+	r := make([]EntryDiff, len(keys))
+	for i, k := range keys {
+		r[i] = EntryDiff{
+			Hash:     k,
+			Current:  o.current[k] - current[k],
+			History:  o.history[k] - history[k],
+			Interval: o.intervals[k] - intervals[k],
+		}
+	}
+	o.m.RUnlock()
+
+	sort.Slice(r, func(i, j int) bool {
+		return rankedBefore(math.Abs(r[i].Current), r[i].Hash, math.Abs(r[j].Current), r[j].Hash)
+	})
+
+	return r
+}
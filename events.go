@@ -0,0 +1,90 @@
+package opic
+
+import (
+	"sync"
+)
+
+// EventKind identifies the kind of change an Event describes.
+type EventKind int
+
+const (
+	// EventDistribute is emitted when cash is distributed from a source.
+	// Key is the source and Amount is the cash distributed.
+	EventDistribute EventKind = iota + 1
+	// EventFinalise is emitted for each entry finalised. Amount is the cash
+	// moved into its history.
+	EventFinalise
+	// EventEvict is emitted when an entry is evicted automatically. Amount is
+	// the current cash it held.
+	EventEvict
+	// EventDelete is emitted when an entry is removed explicitly. Amount is
+	// the current cash it held.
+	EventDelete
+	// EventRebalance is emitted when cash is moved around the system as a
+	// whole rather than for a single entry, in which case Key is zero.
+	EventRebalance
+)
+
+// Event describes a change to the state of an OPIC instance.
+type Event struct {
+	Kind   EventKind
+	Key    uint64
+	Amount float64
+}
+
+// eventBuffer is the capacity of each subscriber's channel.
+const eventBuffer = 256
+
+// Subscribe returns a channel that receives an Event for every change to the
+// state, and a function that ends the subscription and closes the channel.
+// Delivery is best effort: events are sent without blocking the operation
+// that caused them, so if the channel's buffer is full the event is dropped
+// and counted in DroppedEvents. Subscribers should drain the channel
+// promptly, and must call the returned function when they're done.
+func (o *OPIC) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+
+	o.m.Lock()
+	if o.subs == nil {
+		o.subs = make(map[chan Event]struct{})
+	}
+	o.subs[ch] = struct{}{}
+	o.m.Unlock()
+
+	var once sync.Once
+
+	return ch, func() {
+		once.Do(func() {
+			o.m.Lock()
+			delete(o.subs, ch)
+			close(ch)
+			o.m.Unlock()
+		})
+	}
+}
+
+// DroppedEvents returns how many events have been dropped because a
+// subscriber's channel was full.
+func (o *OPIC) DroppedEvents() uint64 {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	return o.dropped
+}
+
+// emit sends an event to every subscriber without blocking. It must be called
+// with the write lock held.
+func (o *OPIC) emit(kind EventKind, key uint64, amount float64) {
+	if o.holding {
+		o.held = append(o.held, Event{Kind: kind, Key: key, Amount: amount})
+		return
+	}
+
+	for ch := range o.subs {
+		select {
+		case ch <- Event{Kind: kind, Key: key, Amount: amount}:
+		default:
+			o.dropped++
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module fknsrs.biz/p/opic
+
+go 1.21
@@ -0,0 +1,202 @@
+package opic
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// importCheckpoint is how many URLs ImportResumable reads between
+// checkpoints. It's only a variable so that tests can lower it.
+var importCheckpoint = 100000
+
+// ImportResumable seeds the instance from a list of URLs, one per line with
+// anything after a tab ignored, splitting cash evenly between them like
+// Initialise. It's meant for seed lists big enough that being interrupted
+// part way through is a real possibility.
+//
+// Every so often it saves the state and then records how far through r it
+// got in progressFile. If it's run again with the same input after being
+// interrupted, it picks up from the last checkpoint instead of starting over.
+// This lives on Persistent rather than OPIC because the progress is only
+// meaningful alongside a saved state that matches it. Each URL's cash is set
+// rather than added to, so anything re-read after a crash between a save and
+// its progress update ends up the same as if it had only been read once.
+// Because of that, a URL that appears more than once only gets one share.
+//
+// So that every saved state has the right total, all of the cash is first
+// given to the virtual entry, and each URL's share is taken from it as the
+// URL is imported. Any cash a URL already had goes back to the virtual entry,
+// as does the share of a repeated URL, and any rounding error left over at
+// the end. The progress file remembers the ContentHash of the state from
+// before the cash was added, so that a crash between recording the progress
+// and saving the state doesn't add it twice.
+//
+// The input is read twice: once to count the URLs, so that every run
+// calculates the same share, and once to import them. The progress file is
+// removed when the import completes.
+func (p *Persistent) ImportResumable(r io.ReadSeeker, progressFile string, cash float64) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var total int
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		if importURL(s.Text()) != "" {
+			total++
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	share := cash / float64(total)
+
+	offset, before, ok, err := readProgress(progressFile)
+	if err != nil {
+		return err
+	}
+
+	// the progress is written before the cash is added, so the state can
+	// still be the one from before if it wasn't saved
+	if !ok || (offset == 0 && p.ContentHash() == before) {
+		if !ok {
+			before = p.ContentHash()
+		}
+
+		if err := writeProgress(progressFile, 0, before); err != nil {
+			return err
+		}
+
+		p.m.Lock()
+		p.current[0] = p.current[0] + cash
+		p.changed()
+		p.m.Unlock()
+
+		if err := p.Save(nil); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	var batch []uint64
+	var names []string
+
+	checkpoint := func() error {
+		p.m.Lock()
+		p.noteURLs(names, batch)
+		for _, k := range batch {
+			p.current[0] = p.current[0] - (share - p.current[k])
+			p.current[k] = share
+		}
+		p.changed()
+		p.m.Unlock()
+
+		batch, names = batch[:0], names[:0]
+
+		if err := p.Save(nil); err != nil {
+			return err
+		}
+
+		return writeProgress(progressFile, offset, before)
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		l, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		offset += int64(len(l))
+
+		if u := importURL(l); u != "" {
+			batch = append(batch, p.hash(u))
+			names = append(names, u)
+		}
+
+		if len(batch) >= importCheckpoint {
+			if err := checkpoint(); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if err := checkpoint(); err != nil {
+		return err
+	}
+
+	return os.Remove(progressFile)
+}
+
+// importURL pulls the URL out of a line of an import file, in the same way as
+// the command line tool.
+func importURL(l string) string {
+	return strings.SplitN(strings.TrimRight(l, " \r\n"), "\t", 2)[0]
+}
+
+// readProgress reads the offset and the ContentHash of the state from before
+// the import from a progress file, and reports whether there was one.
+func readProgress(filename string) (int64, uint64, bool, error) {
+	d, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, false, nil
+		}
+
+		return 0, 0, false, err
+	}
+
+	f := strings.Fields(string(d))
+	if len(f) != 2 {
+		return 0, 0, false, fmt.Errorf("invalid progress file %s", filename)
+	}
+
+	offset, err := strconv.ParseInt(f[0], 10, 64)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	before, err := strconv.ParseUint(f[1], 10, 64)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	return offset, before, true, nil
+}
+
+func writeProgress(filename string, offset int64, before uint64) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "opic")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(strconv.FormatInt(offset, 10) + " " + strconv.FormatUint(before, 10) + "\n"); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,132 @@
+package opic
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// failingReader fails once limit bytes have been read after the input has
+// been rewound for the second time, i.e. part way through the import rather
+// than while the URLs are being counted.
+type failingReader struct {
+	r     *bytes.Reader
+	seeks int
+	limit int
+}
+
+func (f *failingReader) Read(b []byte) (int, error) {
+	if f.seeks < 2 {
+		return f.r.Read(b)
+	}
+
+	if f.limit <= 0 {
+		return 0, errors.New("interrupted")
+	}
+	if len(b) > f.limit {
+		b = b[:f.limit]
+	}
+
+	n, err := f.r.Read(b)
+	f.limit -= n
+
+	return n, err
+}
+
+func (f *failingReader) Seek(offset int64, whence int) (int64, error) {
+	f.seeks++
+
+	return f.r.Seek(offset, whence)
+}
+
+func checkImportTotal(t *testing.T, o *OPIC, expected float64) {
+	t.Helper()
+
+	if _, c := o.Sums(); math.Abs(c-expected) > 1e-12 {
+		t.Errorf("expected a current total of %v but got %v", expected, c)
+	}
+}
+
+func TestImportResumable(t *testing.T) {
+	defer func(n int) { importCheckpoint = n }(importCheckpoint)
+	importCheckpoint = 10
+
+	dir, err := ioutil.TempDir("", "opic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "state.opic")
+	progress := filepath.Join(dir, "progress")
+
+	var input bytes.Buffer
+	var lines []int
+	for i := 0; i < 35; i++ {
+		fmt.Fprintf(&input, "http://example.com/%d\tignored\n", i)
+		lines = append(lines, input.Len())
+	}
+
+	p := NewPersistent(filename)
+	p.Initialise(0.5, []string{"existing"})
+	if err := p.Save(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// interrupted after the second checkpoint, part way through the third
+	r := &failingReader{r: bytes.NewReader(input.Bytes()), limit: lines[24]}
+	if err := p.ImportResumable(r, progress, 1); err == nil {
+		t.Fatal("expected the import to be interrupted")
+	}
+
+	p = NewPersistent(filename)
+	if err := p.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	checkImportTotal(t, p.OPIC, 1.5)
+	if n := p.Len(); n != 21 {
+		t.Errorf("expected 20 URLs to have been imported but got %d", n-1)
+	}
+
+	offset, before, ok, err := readProgress(progress)
+	if err != nil || !ok {
+		t.Fatalf("expected progress to be recorded, got %v", err)
+	}
+	if offset != int64(lines[19]) {
+		t.Errorf("expected progress to be at offset %d but got %d", lines[19], offset)
+	}
+
+	// as if the last checkpoint's state was saved but its progress wasn't
+	if err := writeProgress(progress, int64(lines[9]), before); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.ImportResumable(bytes.NewReader(input.Bytes()), progress, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	p = NewPersistent(filename)
+	if err := p.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	checkImportTotal(t, p.OPIC, 1.5)
+	for i := 0; i < 35; i++ {
+		if _, c, _ := p.Get(fmt.Sprintf("http://example.com/%d", i)); math.Abs(c-1.0/35) > 1e-15 {
+			t.Errorf("expected URL %d to have %v but got %v", i, 1.0/35, c)
+		}
+	}
+	if _, c, _ := p.Get("existing"); c != 0.5 {
+		t.Errorf("expected the existing URL to keep 0.5 but got %v", c)
+	}
+
+	if _, err := os.Stat(progress); !os.IsNotExist(err) {
+		t.Errorf("expected the progress file to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package opic
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// jsonState is the JSON form of a dataset. Keys are written as decimal
+// strings, since JSON object keys have to be strings.
+type jsonState struct {
+	Current map[uint64]float64   `json:"current"`
+	History map[uint64]float64   `json:"history"`
+	Cleared map[uint64]time.Time `json:"cleared"`
+	// Intervals are in nanoseconds.
+	Intervals map[uint64]time.Duration `json:"intervals,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler, encoding the dataset as an object
+// holding the three internal maps, with cleared times in RFC3339 format. Map
+// keys are sorted, so the output is deterministic. It's meant for inspecting
+// small to medium sized states with other tools: the whole output is built
+// in memory, and it's many times the size of the binary format. It fails if
+// any value isn't finite, since JSON can't represent that.
+func (s *Serialisable) MarshalJSON() ([]byte, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return json.Marshal(jsonState{
+		Current:   s.current,
+		History:   s.history,
+		Cleared:   s.cleared,
+		Intervals: s.intervals,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler, decoding a dataset encoded by
+// MarshalJSON. Like ReadFrom, the entries read are added to the existing
+// state, and nothing is changed if the input can't be decoded.
+func (s *Serialisable) UnmarshalJSON(d []byte) error {
+	var st jsonState
+	if err := json.Unmarshal(d, &st); err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.unlogged()
+
+	for k, v := range st.Current {
+		s.current[k] = v
+	}
+	for k, v := range st.History {
+		s.history[k] = v
+	}
+	for k, v := range st.Cleared {
+		s.cleared[k] = v
+	}
+	for k, v := range st.Intervals {
+		if v <= 0 {
+			continue
+		}
+		if s.intervals == nil {
+			s.intervals = make(map[uint64]time.Duration)
+		}
+		s.intervals[k] = v
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package opic
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an advisory lock on a sidecar file next to filename,
+// blocking until it's available. A sidecar is used rather than the file
+// itself because Save replaces the file, and a lock on the old one would be
+// invisible to anyone opening the new one.
+func lockFile(filename string, exclusive bool) (func() error, error) {
+	f, err := os.OpenFile(filename+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() error {
+		defer f.Close()
+		return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	}, nil
+}
+
+// ownFile takes an exclusive advisory lock on a sidecar file next to
+// filename, failing straight away if another process already has it. It uses
+// a different sidecar to lockFile, so that the owner can still take the
+// locks used for loading and saving.
+func ownFile(filename string) (func() error, error) {
+	f, err := os.OpenFile(filename+".owner", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s is in use by another process", filename)
+		}
+
+		return nil, err
+	}
+
+	return func() error {
+		defer f.Close()
+		return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package opic
+
+// lockFile is a no-op on platforms without flock.
+func lockFile(filename string, exclusive bool) (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+// ownFile is a no-op on platforms without flock.
+func ownFile(filename string) (func() error, error) {
+	return func() error { return nil }, nil
+}
@@ -0,0 +1,127 @@
+package opic
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Approximate bytes per entry of each kind of map. A Go map stores its
+// entries in buckets of 8, each holding 8 bytes of tophash, the 8 keys, the 8
+// values and an 8 byte overflow pointer, and grows once buckets are 6.5/8
+// full on average. With 8 byte keys, that's (8 + 8*8 + 8*v + 8) / 6.5 bytes
+// per entry for a value of v bytes:
+//
+//	float64 or time.Duration values (8 bytes):  144 / 6.5 ≈ 22
+//	time.Time values (24 bytes):                272 / 6.5 ≈ 42
+//
+// Other map implementations, and maps that have only just grown, will differ,
+// so these are only good to within a factor of two or so.
+const (
+	mapEntryBytes8  = 22
+	mapEntryBytes24 = 42
+)
+
+// ApproxMemoryBytes estimates how much memory the state is using, from the
+// sizes of the internal maps. Maps never give memory back as entries are
+// deleted, so it uses the largest size each has had (see MapStats). It
+// doesn't include the URL map kept by SetTrackURLs, whose size depends on the
+// URLs themselves.
+func (o *OPIC) ApproxMemoryBytes() uint64 {
+	s := o.MapStats()
+
+	o.m.RLock()
+	intervals := len(o.intervals)
+	o.m.RUnlock()
+
+	return approxMemoryBytes(uint64(s.Current.Cap), uint64(s.History.Cap), uint64(s.Cleared.Cap), uint64(intervals))
+}
+
+func approxMemoryBytes(current, history, cleared, intervals uint64) uint64 {
+	return (current+history+intervals)*mapEntryBytes8 + cleared*mapEntryBytes24
+}
+
+// EstimateFileMemory estimates how much memory the state in a file written by
+// Persistent.Save would take once loaded, in the same way as
+// ApproxMemoryBytes, without loading it. Only the section headers are read;
+// the entries are skipped over, although a gzipped file still has to be
+// decompressed to find them.
+func EstimateFileMemory(filename string) (uint64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+
+	var r io.Reader = br
+	// skipping is done by seeking the file, unless it's compressed
+	skip := func(n int64) error {
+		if _, err := f.Seek(n-int64(br.Buffered()), io.SeekCurrent); err != nil {
+			return err
+		}
+
+		br.Reset(f)
+
+		return nil
+	}
+
+	if isGzipped(br) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+
+		r = zr
+		skip = func(n int64) error {
+			_, err := io.CopyN(ioutil.Discard, zr, n)
+			return err
+		}
+	}
+
+	var header struct {
+		Magic   [8]byte
+		Version uint64
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return 0, fmt.Errorf("reading header: %w", err)
+	}
+
+	if string(header.Magic[:]) != expectedMagic {
+		return 0, fmt.Errorf("invalid magic")
+	}
+
+	v := header.Version
+	if !supportedVersion(v) {
+		return 0, fmt.Errorf("unsupported version; expected %d to %d but got %d", versionNoChecksum, expectedVersion, v)
+	}
+
+	sections := []string{"current", "history", "cleared"}
+	if v > versionNoIntervals {
+		sections = append(sections, "intervals")
+	}
+
+	counts := make([]uint64, 4)
+	for i, name := range sections {
+		if err := binary.Read(r, binary.BigEndian, &counts[i]); err != nil {
+			return 0, fmt.Errorf("reading %s count: %w", name, err)
+		}
+
+		// the last section doesn't need skipping
+		if i == len(sections)-1 {
+			break
+		}
+
+		if err := skip(int64(counts[i]) * 16); err != nil {
+			return 0, fmt.Errorf("skipping %s entries: %w", name, err)
+		}
+	}
+
+	return approxMemoryBytes(counts[0], counts[1], counts[2], counts[3]), nil
+}
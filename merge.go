@@ -0,0 +1,117 @@
+package opic
+
+import (
+	"io"
+	"time"
+)
+
+// MergeOptions controls how Merge combines two instances.
+type MergeOptions struct {
+	// MinCash skips incoming entries (other than the virtual one) whose
+	// current cash and history are both below it. This keeps the long tail
+	// of near-zero entries out of the merged state, at the cost of their
+	// cash: it's lost, unless PoolSkipped is set. History counts as well as
+	// current cash so that an entry that has just been finalised, which holds
+	// all of its importance in history, isn't mistaken for part of the tail.
+	MinCash float64
+	// PoolSkipped adds the cash of entries skipped because of MinCash to the
+	// virtual entry, so the merged total is the same as a full merge.
+	PoolSkipped bool
+	// HistoryMax keeps the larger of the two history values for each key,
+	// rather than their sum. That suits shards that crawl overlapping parts
+	// of the web, where summing would count the same history twice.
+	HistoryMax bool
+}
+
+type mergeEntry struct {
+	k        uint64
+	c, h     float64
+	t        time.Time
+	i        time.Duration
+	cok, hok bool
+	tok      bool
+}
+
+// Merge adds the state of other into o, for combining shards of a crawl.
+// For each key, current values are summed, history values are summed (or the
+// larger kept, see MergeOptions.HistoryMax), the most recent cleared time
+// is kept, and a per-entry interval is only taken from other if o doesn't
+// have one. The virtual entry is combined like any other, so the
+// merged sums are the sums of both sides. A nil opts does a full merge.
+func (o *OPIC) Merge(other *OPIC, opts *MergeOptions) {
+	var minCash float64
+	var pool, historyMax bool
+	if opts != nil {
+		minCash, pool, historyMax = opts.MinCash, opts.PoolSkipped, opts.HistoryMax
+	}
+
+	other.m.RLock()
+	keys := other.sortedKeys()
+	in := make([]mergeEntry, len(keys))
+	for i, k := range keys {
+		e := mergeEntry{k: k}
+		e.c, e.cok = other.current[k]
+		e.h, e.hok = other.history[k]
+		e.t, e.tok = other.cleared[k]
+		e.i = other.intervals[k]
+		in[i] = e
+	}
+	other.m.RUnlock()
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	for _, e := range in {
+		if e.k != 0 && e.c < minCash && e.h < minCash {
+			if pool {
+				o.current[0] = o.current[0] + e.c
+				o.history[0] = o.history[0] + e.h
+			}
+			continue
+		}
+
+		if e.cok {
+			o.current[e.k] = o.current[e.k] + e.c
+		}
+		if e.hok {
+			if h, ok := o.history[e.k]; historyMax && ok {
+				if e.h > h {
+					o.history[e.k] = e.h
+				}
+			} else {
+				o.history[e.k] = h + e.h
+			}
+		}
+		if e.tok {
+			if t, ok := o.cleared[e.k]; !ok || e.t.After(t) {
+				o.cleared[e.k] = e.t
+			}
+		}
+		if _, ok := o.intervals[e.k]; e.i > 0 && !ok {
+			if o.intervals == nil {
+				o.intervals = make(map[uint64]time.Duration)
+			}
+			o.intervals[e.k] = e.i
+		}
+	}
+
+	if len(in) > 0 {
+		o.changed()
+	}
+}
+
+// MergeFrom reads a serialised state from r, as written by WriteTo, and
+// merges it into s. It's a convenient way to fold shard files together
+// without keeping each of them loaded.
+func (s *Serialisable) MergeFrom(r io.Reader, opts *MergeOptions) (int64, error) {
+	in := &Serialisable{OPIC: New()}
+
+	n, err := in.ReadFrom(r)
+	if err != nil {
+		return n, err
+	}
+
+	s.Merge(in.OPIC, opts)
+
+	return n, nil
+}
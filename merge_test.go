@@ -0,0 +1,47 @@
+package opic
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMergeMinCash(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	other := New()
+	other.Initialise(1, []string{"a", "b", "c", "d"})
+	other.Distribute("a", []string{"b", "c"}, t0)
+	other.Finalise([]string{"c"})
+	other.Initialise(0.001, []string{"tail"})
+
+	full := New()
+	full.Merge(other, nil)
+
+	for _, pool := range []bool{false, true} {
+		o := New()
+		o.Merge(other, &MergeOptions{MinCash: 0.01, PoolSkipped: pool})
+
+		if o.ContainsN(o.hash("tail")) {
+			t.Errorf("pool=%v: expected the entry below the threshold to be skipped", pool)
+		}
+
+		// c was just finalised, so its importance is all in its history
+		for _, s := range []string{"a", "b", "c", "d"} {
+			fh, fc, _ := full.Get(s)
+			h, c, _ := o.Get(s)
+			if h != fh || c != fc {
+				t.Errorf("pool=%v: expected %s to merge as %v/%v but got %v/%v", pool, s, fh, fc, h, c)
+			}
+		}
+
+		fh, fc := full.Sums()
+		h, c := o.Sums()
+		if !pool {
+			fc -= 0.001
+		}
+		if math.Abs(h-fh) > 1e-12 || math.Abs(c-fc) > 1e-12 {
+			t.Errorf("pool=%v: expected sums of %v/%v but got %v/%v", pool, fh, fc, h, c)
+		}
+	}
+}
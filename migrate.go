@@ -0,0 +1,41 @@
+package opic
+
+import (
+	"bufio"
+	"os"
+)
+
+// isGzipped reports whether the input in br starts with the gzip magic
+// number, without consuming it.
+func isGzipped(br *bufio.Reader) bool {
+	magic, err := br.Peek(2)
+
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+// Migrate reads the state in oldFile, written by any version of the format
+// that can still be read, and writes it to newFile in the current version, so
+// that old files can be converted ahead of time rather than on their next
+// Save. newFile is gzipped if oldFile was. The two can be the same file, in
+// which case it's replaced atomically, in the same way as Save.
+func Migrate(oldFile, newFile string) error {
+	f, err := os.Open(oldFile)
+	if err != nil {
+		return err
+	}
+	compressed := isGzipped(bufio.NewReader(f))
+	f.Close()
+
+	src := NewPersistent(oldFile)
+	if err := src.Load(nil); err != nil {
+		return err
+	}
+
+	dst := &Persistent{
+		Serialisable: src.Serialisable,
+		filename:     newFile,
+		compress:     compressed,
+	}
+
+	return dst.Save(nil)
+}
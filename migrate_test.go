@@ -0,0 +1,127 @@
+package opic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testdata/v1.opic was written by version 1 of the format, before the
+// checksum and per-entry intervals were added and while cleared times were
+// stored in whole seconds.
+const v1Fixture = "testdata/v1.opic"
+
+func checkV1Fixture(t *testing.T, o *OPIC) {
+	t.Helper()
+
+	expected := []struct {
+		k       uint64
+		history float64
+		current float64
+		cleared time.Time
+	}{
+		{0, 0, 0.125, time.Time{}},
+		{1, 0.75, 0.5, time.Unix(1577836800, 0)},
+		{2, 0.0625, 0.25, time.Unix(1577840400, 0)},
+		{3, 0, 0.125, time.Time{}},
+	}
+
+	for _, e := range expected {
+		h, c, ct := o.GetN(e.k)
+		if h != e.history || c != e.current || !ct.Equal(e.cleared) {
+			t.Errorf("entry %d: expected %v, %v, %v but got %v, %v, %v", e.k, e.history, e.current, e.cleared, h, c, ct)
+		}
+	}
+
+	if n := o.Len(); n != 3 {
+		t.Errorf("expected 3 entries but got %d", n)
+	}
+}
+
+func TestReadV1(t *testing.T) {
+	f, err := os.Open(v1Fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	s := &Serialisable{OPIC: New()}
+
+	_, report, err := s.ReadFromWithOptions(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.CurrentCount != 4 || report.HistoryCount != 2 || report.ClearedCount != 2 || report.IntervalCount != 0 {
+		t.Errorf("unexpected counts in %+v", report)
+	}
+
+	checkV1Fixture(t, s.OPIC)
+}
+
+func TestMigrateV1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "migrated.opic")
+
+	if err := Migrate(v1Fixture, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := binary.BigEndian.Uint64(d[8:16]); v != expectedVersion {
+		t.Errorf("expected version %d but got %d", expectedVersion, v)
+	}
+
+	p := NewPersistent(filename)
+	if err := p.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	checkV1Fixture(t, p.OPIC)
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	d, err := ioutil.ReadFile(v1Fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint64(d[8:16], expectedVersion+4)
+
+	dir, err := ioutil.TempDir("", "opic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "future.opic")
+	if err := ioutil.WriteFile(filename, d, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the error has to say which versions would have worked, not just the
+	// newest one, as well as which version was found
+	expected := fmt.Sprintf("expected %d to %d but got %d", versionNoChecksum, expectedVersion, expectedVersion+4)
+
+	s := &Serialisable{OPIC: New()}
+	if _, err := s.ReadFrom(bytes.NewReader(d)); err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected ReadFrom to fail with %q, got %v", expected, err)
+	}
+
+	if _, err := EstimateFileMemory(filename); err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected EstimateFileMemory to fail with %q, got %v", expected, err)
+	}
+}
@@ -0,0 +1,54 @@
+package opic
+
+import (
+	"math"
+	"time"
+)
+
+// EstimateModel turns what's known about an entry into an estimate of its
+// importance, for experimenting with different ways of ageing history. It's
+// given the entry's history and current cash, how long it's been since the
+// entry was cleared, and the interval. elapsed is never negative, and
+// interval is always positive; the cases where they wouldn't be are handled
+// before the model is asked.
+type EstimateModel interface {
+	Estimate(history, current float64, elapsed, interval time.Duration) float64
+}
+
+// DefaultModel is the model used unless another is set with SetEstimateModel.
+// Within the interval, the history fades linearly to nothing, on top of the
+// current cash. After the interval, the current cash is scaled down by how
+// far past the interval it is.
+type DefaultModel struct{}
+
+// Estimate implements EstimateModel.
+func (DefaultModel) Estimate(history, current float64, elapsed, interval time.Duration) float64 {
+	if elapsed < interval {
+		return history*(float64(interval)-float64(elapsed))/float64(interval) + current
+	}
+
+	return current * (float64(interval) / float64(elapsed))
+}
+
+// ExponentialModel decays the history exponentially, with the interval as its
+// time constant, on top of the current cash. Unlike DefaultModel, history
+// never quite stops counting, and current cash is never scaled down.
+type ExponentialModel struct{}
+
+// Estimate implements EstimateModel.
+func (ExponentialModel) Estimate(history, current float64, elapsed, interval time.Duration) float64 {
+	return history*math.Exp(-float64(elapsed)/float64(interval)) + current
+}
+
+// SetEstimateModel sets the model used by the Estimate family of methods, and
+// by everything that ranks on estimates. A nil model restores DefaultModel.
+func (o *OPIC) SetEstimateModel(m EstimateModel) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if m == nil {
+		m = DefaultModel{}
+	}
+
+	o.model = m
+}
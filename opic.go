@@ -1,130 +1,1438 @@
 package opic
 
 import (
+	"encoding/binary"
+	"fmt"
 	"hash/fnv"
+	"math"
+	"runtime"
+	"sort"
 	"sync"
 	"time"
 )
 
+// HashFunc maps a URL to the numeric hash that identifies its entry.
+type HashFunc func(string) uint64
+
 func fnvHash(s string) uint64 {
 	h := fnv.New64()
 	h.Write([]byte(s))
 	return h.Sum64()
 }
 
-// OPIC holds all the state for running the Adaptive OPIC algorithm.
-type OPIC struct {
-	m sync.RWMutex
+// OPIC holds all the state for running the Adaptive OPIC algorithm.
+type OPIC struct {
+	m sync.RWMutex
+
+	hash  HashFunc
+	clock Clock
+
+	dirty bool
+
+	current map[uint64]float64
+	cleared map[uint64]time.Time
+	history map[uint64]float64
+
+	// per-entry intervals, overriding the one passed to Estimate; nil until
+	// the first is set
+	intervals map[uint64]time.Duration
+
+	recent     []uint64
+	recentNext int
+	recentLen  int
+
+	unseen         float64
+	ttl            time.Duration
+	skipDegenerate bool
+	minShare       float64
+	model          EstimateModel
+
+	onEvict func(key uint64, current, history float64)
+
+	// called before each distribution, with a fraction of 1 unless it's
+	// partial, and after any other change, for the write-ahead log
+	onDistribute func(source uint64, out []uint64, weights []float64, fraction float64, t time.Time)
+	onUnlogged   func()
+
+	// high water marks of the maps, which never give memory back
+	currentPeak, historyPeak, clearedPeak int
+
+	subs    map[chan Event]struct{}
+	dropped uint64
+
+	// while a transaction is running, events are held back until it commits
+	holding bool
+	held    []Event
+
+	urls       map[uint64]string
+	collisions []Collision
+}
+
+// New constructs a new OPIC object, using 64 bit FNV-1 to hash URLs.
+func New() *OPIC {
+	return NewWithHash(fnvHash)
+}
+
+// NewWithHash constructs a new OPIC object that uses h to hash URLs, e.g. to
+// reduce collisions or to match the keys of an external system. Every method
+// that takes a URL as a string goes through h, so the same function must be
+// used for the lifetime of the data, including across Save and Load.
+func NewWithHash(h HashFunc) *OPIC {
+	return &OPIC{
+		hash:    h,
+		clock:   realClock{},
+		model:   DefaultModel{},
+		current: make(map[uint64]float64),
+		cleared: make(map[uint64]time.Time),
+		history: make(map[uint64]float64),
+	}
+}
+
+// Snapshot returns an independent copy of the state, taken under the read
+// lock, so that expensive computations can run on the copy without holding
+// up writers. The copy shares the hash function, clock and estimation
+// settings of the original, and tracks URLs if the original does, but has no
+// event subscribers, eviction callback, or recent sources.
+func (o *OPIC) Snapshot() *OPIC {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	r := NewWithHash(o.hash)
+	r.clock = o.clock
+
+	for k, v := range o.current {
+		r.current[k] = v
+	}
+	for k, v := range o.history {
+		r.history[k] = v
+	}
+	for k, v := range o.cleared {
+		r.cleared[k] = v
+	}
+
+	if o.intervals != nil {
+		r.intervals = make(map[uint64]time.Duration, len(o.intervals))
+		for k, v := range o.intervals {
+			r.intervals[k] = v
+		}
+	}
+
+	if o.urls != nil {
+		r.urls = make(map[uint64]string, len(o.urls))
+		for k, v := range o.urls {
+			r.urls[k] = v
+		}
+	}
+
+	r.unseen = o.unseen
+	r.ttl = o.ttl
+	r.skipDegenerate = o.skipDegenerate
+	r.minShare = o.minShare
+	r.model = o.model
+
+	return r
+}
+
+// InitialiseN sets the total cash for the system, and distributes it evenly
+// amongst a collection of URLs referenced by numeric hash. It does nothing if
+// the collection is empty.
+func (o *OPIC) InitialiseN(cash float64, in []uint64) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.initialise(cash, in)
+}
+
+// initialise is the implementation of InitialiseN. It must be called with the
+// write lock held.
+func (o *OPIC) initialise(cash float64, in []uint64) {
+	// there's nobody to give the cash to, and dividing by zero would poison
+	// everything with NaN or Inf
+	if len(in) == 0 {
+		return
+	}
+
+	n := cash / float64(len(in))
+
+	for _, u := range in {
+		o.current[u] = n
+	}
+
+	o.changed()
+}
+
+// Initialise sets the total cash for the system, and distributes it evenly
+// amongst a collection of URLs.
+func (o *OPIC) Initialise(cash float64, in []string) {
+	ids := o.hashList(in)
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.noteURLs(in, ids)
+	o.initialise(cash, ids)
+}
+
+// RegisterN makes an entry, referenced by numeric hash, known to the system
+// without giving it any cash, e.g. to fill the frontier from a sitemap before
+// crawling. It's given a current value of zero and, unless it already has a
+// cleared time, marked as cleared at the time given by the instance's clock
+// (see SetClock). It does nothing if the entry already has a current value,
+// and returns whether it was added.
+func (o *OPIC) RegisterN(v uint64) bool {
+	if v == 0 {
+		return false
+	}
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	return o.register(v)
+}
+
+// register is the implementation of RegisterN. It must be called with the
+// write lock held.
+func (o *OPIC) register(v uint64) bool {
+	if _, ok := o.current[v]; ok {
+		return false
+	}
+
+	o.current[v] = 0
+	if _, ok := o.cleared[v]; !ok {
+		o.cleared[v] = o.clock.Now()
+	}
+
+	o.changed()
+
+	return true
+}
+
+// Register makes an entry known without giving it any cash. See RegisterN.
+func (o *OPIC) Register(s string) bool {
+	v := o.hash(s)
+	if v == 0 {
+		return false
+	}
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.noteURL(v, s)
+
+	return o.register(v)
+}
+
+// SetTrackURLs turns the reverse map from hashes back to URLs, used by URL,
+// on or off. It's off by default to save memory. Once on, any method given a
+// URL as a string remembers it. Turning it off forgets every URL remembered
+// so far. The map is written out by WriteTo, and so saved by Persistent, but
+// ReadFrom only keeps the URLs it reads if tracking is already on, so turn it
+// on before loading. Other forms of the state, and the write-ahead log, don't
+// carry URLs, so any first seen since the last save are lost in a crash.
+func (o *OPIC) SetTrackURLs(enabled bool) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	switch {
+	case enabled && o.urls == nil:
+		o.urls = make(map[uint64]string)
+	case !enabled:
+		o.urls = nil
+	}
+}
+
+// URL returns the URL that a hash was calculated from, if it's known. URLs
+// are only known if SetTrackURLs is on.
+func (o *OPIC) URL(v uint64) (string, bool) {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	s, ok := o.urls[v]
+
+	return s, ok
+}
+
+// Collision records two different URLs that hash to the same value, and so
+// share a single entry.
+type Collision struct {
+	Hash     uint64
+	Existing string
+	Incoming string
+}
+
+// Collisions returns a copy of every hash collision seen so far, in the order
+// they were seen. Collisions can only be detected while SetTrackURLs is on.
+func (o *OPIC) Collisions() []Collision {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	return append([]Collision(nil), o.collisions...)
+}
+
+// noteURL remembers the URL for a hash if URLs are being tracked, recording a
+// collision if the hash already belongs to a different URL. The first URL
+// seen for a hash is the one kept. It must be called with the write lock
+// held.
+func (o *OPIC) noteURL(v uint64, s string) {
+	if o.urls == nil {
+		return
+	}
+
+	if e, ok := o.urls[v]; ok {
+		if e != s {
+			o.collisions = append(o.collisions, Collision{Hash: v, Existing: e, Incoming: s})
+		}
+
+		return
+	}
+
+	o.urls[v] = s
+}
+
+// noteURLs is noteURL for parallel lists of URLs and their hashes.
+func (o *OPIC) noteURLs(in []string, ids []uint64) {
+	if o.urls == nil {
+		return
+	}
+
+	for i, s := range in {
+		o.noteURL(ids[i], s)
+	}
+}
+
+func (o *OPIC) hashList(in []string) []uint64 {
+	ids := make([]uint64, len(in))
+	for i, s := range in {
+		ids[i] = o.hash(s)
+	}
+
+	return ids
+}
+
+// InitialiseHierarchical is like Initialise, but splits the cash evenly
+// between domains first, and then evenly between the URLs within each
+// domain. That stops domains with lots of seed URLs from getting a larger
+// share of the cash. Each URL without a cleared time is marked as cleared at
+// t, so that its estimate starts from the seeded cash. See
+// InitialiseHierarchicalWeighted for uneven splits between domains.
+func (o *OPIC) InitialiseHierarchical(cash float64, byDomain map[string][]string, t time.Time) {
+	o.InitialiseHierarchicalWeighted(cash, byDomain, nil, t)
+}
+
+// InitialiseHierarchicalWeighted is like InitialiseHierarchical, but splits
+// the cash between domains in proportion to weights. A nil weights map gives
+// every domain a weight of 1, otherwise domains missing from it (or with a
+// weight that isn't positive) get nothing. Rounding errors are absorbed by
+// the last domain and URL in sorted order, so the URLs' cash adds up to
+// exactly cash, and a URL listed under more than one domain gets the sum of
+// its shares.
+func (o *OPIC) InitialiseHierarchicalWeighted(cash float64, byDomain map[string][]string, weights map[string]float64, t time.Time) {
+	var domains []string
+	var total float64
+	for d, urls := range byDomain {
+		w := 1.0
+		if weights != nil {
+			w = weights[d]
+		}
+		if len(urls) == 0 || !(w > 0) {
+			continue
+		}
+
+		domains = append(domains, d)
+		total += w
+	}
+	if len(domains) == 0 {
+		return
+	}
+
+	sort.Strings(domains)
+
+	shares := make(map[uint64]float64)
+	names := make(map[uint64]string)
+
+	var given float64
+	for i, d := range domains {
+		ds := cash - given
+		if i < len(domains)-1 {
+			w := 1.0
+			if weights != nil {
+				w = weights[d]
+			}
+			ds = cash * w / total
+		}
+		given += ds
+
+		urls := byDomain[d]
+
+		var dgiven float64
+		for j, u := range urls {
+			us := ds - dgiven
+			if j < len(urls)-1 {
+				us = ds / float64(len(urls))
+			}
+			dgiven += us
+
+			k := o.hash(u)
+			shares[k] += us
+			names[k] = u
+		}
+	}
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	for k, v := range shares {
+		o.noteURL(k, names[k])
+		o.current[k] = v
+		if _, ok := o.cleared[k]; !ok {
+			o.cleared[k] = t
+		}
+	}
+
+	o.changed()
+}
+
+// Distribute distributes the cash from the input to the outputs, and marks
+// the input as having been fetched at t. Outputs seen for the first time are
+// also stamped with t, so replaying a log with explicit times is
+// deterministic. An output listed more than once only gets one share, and
+// links from the source to itself are ignored.
+func (o *OPIC) Distribute(source string, out []string, t time.Time) float64 {
+	sourceH, outH := o.hashAll(source, out)
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.noteURL(sourceH, source)
+	o.noteURLs(out, outH)
+
+	return o.distribute(sourceH, outH, t)
+}
+
+// DistributeWeighted is like Distribute, but splits the outputs' portion of
+// the cash in proportion to weights rather than evenly, e.g. to favour links
+// in the content of a page over those in its footer. The virtual entry gets
+// the same share it would from Distribute. If weights is nil, or they're all
+// zero, the split is even. weights must be the same length as out, and
+// contain only finite, non-negative values.
+func (o *OPIC) DistributeWeighted(source string, out []string, weights []float64, t time.Time) (float64, error) {
+	if weights != nil && len(weights) != len(out) {
+		return 0, fmt.Errorf("got %d weights for %d outputs", len(weights), len(out))
+	}
+	for i, w := range weights {
+		if !validCash(w) {
+			return 0, fmt.Errorf("invalid weight %v for output %d", w, i)
+		}
+	}
+
+	sourceH, outH := o.hashAll(source, out)
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.noteURL(sourceH, source)
+	o.noteURLs(out, outH)
+
+	return o.distributeWeighted(sourceH, outH, weights, t), nil
+}
+
+// DistributeChecked is like Distribute, but also reports whether the source
+// had a current value beforehand. Distribute treats an unknown source as
+// having no cash, so a false result usually means a mistyped or unseeded URL.
+// The distribution happens either way.
+func (o *OPIC) DistributeChecked(source string, out []string, t time.Time) (float64, bool) {
+	sourceH, outH := o.hashAll(source, out)
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	_, ok := o.current[sourceH]
+
+	o.noteURL(sourceH, source)
+	o.noteURLs(out, outH)
+
+	return o.distribute(sourceH, outH, t), ok
+}
+
+// DistributeOp is a single distribution for DistributeMulti.
+type DistributeOp struct {
+	Source string
+	Out    []string
+}
+
+// DistributeMulti applies a batch of distributions, all at t, under a single
+// acquisition of the write lock, for processing many fetched pages at once.
+// The result is the same as calling Distribute for each of them in order, and
+// the cash distributed by each is returned in the same order.
+func (o *OPIC) DistributeMulti(batch []DistributeOp, t time.Time) []float64 {
+	sources := make([]uint64, len(batch))
+	outs := make([][]uint64, len(batch))
+	for i, op := range batch {
+		sources[i], outs[i] = o.hashAll(op.Source, op.Out)
+	}
+
+	r := make([]float64, len(batch))
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	for i, op := range batch {
+		o.noteURL(sources[i], op.Source)
+		o.noteURLs(op.Out, outs[i])
+
+		r[i] = o.distribute(sources[i], outs[i], t)
+	}
+
+	return r
+}
+
+// DistributeN is like Distribute, but takes the source and outputs as
+// numeric hashes, for callers that have already calculated them.
+func (o *OPIC) DistributeN(source uint64, out []uint64, t time.Time) float64 {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	return o.distribute(source, out, t)
+}
+
+// DistributeAndEstimate is like Distribute, but also returns the estimate
+// for the source as of t, calculated under the same lock acquisition. The
+// estimate takes into account that the source has just been fetched at t.
+func (o *OPIC) DistributeAndEstimate(source string, out []string, interval time.Duration, t time.Time) (float64, float64) {
+	sourceH, outH := o.hashAll(source, out)
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.noteURL(sourceH, source)
+	o.noteURLs(out, outH)
+
+	c := o.distribute(sourceH, outH, t)
+
+	return c, o.estimate(sourceH, interval, t)
+}
+
+// DistributePartial distributes only fraction of the source's cash to the
+// outputs, following the same split as Distribute, and leaves the rest with
+// the source. It's meant for fetches that partially failed, and so it doesn't
+// mark the source as fetched or touch its history. The fraction is clamped to
+// [0, 1], and a fraction of 1 is exactly Distribute. When a retry succeeds,
+// call Distribute to hand out the remainder and mark the source as fetched;
+// its history will then reflect only that remainder. It returns the amount
+// of cash distributed.
+func (o *OPIC) DistributePartial(source string, out []string, fraction float64, t time.Time) float64 {
+	if fraction < 0 || math.IsNaN(fraction) {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+
+	sourceH, outH := o.hashAll(source, out)
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.noteURL(sourceH, source)
+	o.noteURLs(out, outH)
+
+	if fraction == 1 {
+		return o.distribute(sourceH, outH, t)
+	}
+
+	return o.distributePartial(sourceH, outH, fraction, t)
+}
+
+// distributePartial is the implementation of DistributePartial for fractions
+// less than 1. The fraction must already have been clamped. It must be called
+// with the write lock held.
+func (o *OPIC) distributePartial(sourceH uint64, out []uint64, fraction float64, t time.Time) float64 {
+	out, _ = dedupe(sourceH, out, nil)
+
+	c := o.current[sourceH] * fraction
+	if c == 0 {
+		return 0
+	}
+
+	if o.onDistribute != nil {
+		o.onDistribute(sourceH, out, nil, fraction, t)
+	}
+
+	o.current[0] = o.current[0] + c/float64(len(out)+1)
+
+	for _, h := range out {
+		share := c / float64(len(out)+1)
+		if share < o.minShare {
+			o.current[0] = o.current[0] + share
+			continue
+		}
+
+		o.current[h] = o.current[h] + share
+		if _, ok := o.cleared[h]; !ok {
+			o.cleared[h] = t
+		}
+	}
+
+	o.current[sourceH] = o.current[sourceH] - c
+
+	o.emit(EventDistribute, sourceH, c)
+
+	o.dirty = true
+
+	return c
+}
+
+// changed marks the state as modified by something other than a
+// distribution. It must be called with the write lock held.
+func (o *OPIC) changed() {
+	o.dirty = true
+
+	o.unlogged()
+}
+
+// unlogged tells the write-ahead log, if there is one, that the state has
+// changed in a way that it can't record. It must be called with the write
+// lock held.
+func (o *OPIC) unlogged() {
+	if o.onUnlogged != nil {
+		o.onUnlogged()
+	}
+}
+
+func (o *OPIC) hashAll(source string, out []string) (uint64, []uint64) {
+	return o.hash(source), o.hashList(out)
+}
+
+// dedupe removes repeated outputs, so that a page linking to the same place
+// several times only gives it one share, and removes links from the source
+// to itself, since the source's own cash is replaced once it's been
+// distributed and a share sent to it would just be lost. The first
+// occurrence of each output is kept, and if there are weights, the weights of
+// its repeats are added to it. The inputs aren't modified.
+func dedupe(source uint64, out []uint64, weights []float64) ([]uint64, []float64) {
+	if len(out) == 0 || (len(out) == 1 && out[0] != source) {
+		return out, weights
+	}
+
+	seen := make(map[uint64]int, len(out))
+
+	r := make([]uint64, 0, len(out))
+	var rw []float64
+	if weights != nil {
+		rw = make([]float64, 0, len(out))
+	}
+
+	for i, v := range out {
+		if v == source {
+			continue
+		}
+
+		if j, ok := seen[v]; ok {
+			if weights != nil {
+				rw[j] += weights[i]
+			}
+			continue
+		}
+
+		seen[v] = len(r)
+		r = append(r, v)
+		if weights != nil {
+			rw = append(rw, weights[i])
+		}
+	}
+
+	return r, rw
+}
+
+// distribute is the implementation of Distribute. It must be called with the
+// write lock held.
+func (o *OPIC) distribute(sourceH uint64, out []uint64, t time.Time) float64 {
+	return o.distributeWeighted(sourceH, out, nil, t)
+}
+
+// distributeWeighted is the implementation of DistributeWeighted, which
+// splits evenly if weights is nil. The weights must already have been
+// validated. It must be called with the write lock held.
+func (o *OPIC) distributeWeighted(sourceH uint64, out []uint64, weights []float64, t time.Time) float64 {
+	out, weights = dedupe(sourceH, out, weights)
+
+	if o.onDistribute != nil {
+		o.onDistribute(sourceH, out, weights, 1, t)
+	}
+
+	c := o.current[sourceH]
+
+	if c == 0 && len(out) == 0 && o.skipDegenerate {
+		return 0
+	}
+
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+
+	o.current[0] = o.current[0] + c/float64(len(out)+1)
+
+	for i, outH := range out {
+		share := c / float64(len(out)+1)
+		if total > 0 {
+			share = c * float64(len(out)) / float64(len(out)+1) * weights[i] / total
+		}
+
+		if share < o.minShare {
+			o.current[0] = o.current[0] + share
+			continue
+		}
+
+		o.current[outH] = o.current[outH] + share
+		if _, ok := o.cleared[outH]; !ok {
+			o.cleared[outH] = t
+		}
+	}
+
+	d := o.current[0] / float64(len(o.current)+1)
+	o.current[0] = o.current[0] - d
+
+	o.current[sourceH] = d
+	o.cleared[sourceH] = t
+	o.history[sourceH] = c
+
+	o.noteRecent(sourceH)
+	o.emit(EventDistribute, sourceH, c)
+
+	o.dirty = true
+
+	return c
+}
+
+// SetSkipDegenerate controls what Distribute does with a source that has no
+// cash and no outputs, e.g. a dead end page that was never in the frontier.
+// Normally nothing is handed out, but the source is still marked as fetched
+// and, like any fetched source, is paid current[0]/(len(current)+1) from the
+// virtual entry; with an unknown source that's cash appearing on a page where
+// no real distribution happened. With skip set, such a call leaves the state
+// completely untouched and returns zero.
+func (o *OPIC) SetSkipDegenerate(skip bool) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.skipDegenerate = skip
+}
+
+// SetMinShare sets the smallest share of cash that Distribute will credit to
+// an output. Shares below it go to the virtual entry instead, so the total is
+// unchanged, and outputs that would only have got such a share aren't
+// created. That keeps sources with very little cash and lots of links from
+// filling the maps with negligible values, at the cost of a bias against
+// pages that are only reachable through such sources, which tend to be deep
+// ones: they never get cash until something with more to give links to them.
+// The default of zero credits every share.
+func (o *OPIC) SetMinShare(threshold float64) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.minShare = threshold
+}
+
+// SetRecentSources sets how many of the most recently distributed sources
+// are remembered for RecentSources. The default of zero disables tracking
+// entirely. Changing the size discards anything remembered so far.
+func (o *OPIC) SetRecentSources(n int) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if n < 0 {
+		n = 0
+	}
+
+	o.recent = make([]uint64, n)
+	o.recentNext = 0
+	o.recentLen = 0
+}
+
+// noteRecent records a distributed source. It must be called with the write
+// lock held.
+func (o *OPIC) noteRecent(v uint64) {
+	if len(o.recent) == 0 {
+		return
+	}
+
+	o.recent[o.recentNext] = v
+	o.recentNext = (o.recentNext + 1) % len(o.recent)
+	if o.recentLen < len(o.recent) {
+		o.recentLen++
+	}
+}
+
+// RecentSources returns up to n of the most recently distributed sources,
+// newest first. It returns nothing unless tracking has been enabled with
+// SetRecentSources.
+func (o *OPIC) RecentSources(n int) []uint64 {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	if n > o.recentLen {
+		n = o.recentLen
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	r := make([]uint64, n)
+	for i := range r {
+		r[i] = o.recent[(o.recentNext-1-i+len(o.recent))%len(o.recent)]
+	}
+
+	return r
+}
+
+// Finalise moves all the current values into the history for the inputs.
+// Their cleared times are left alone, so estimates carry on measuring from
+// when each was last fetched; see FinaliseAt to restart them from the end of
+// an observation window instead.
+func (o *OPIC) Finalise(in []string) {
+	ids := o.hashList(in)
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.finalise(ids)
+}
+
+// FinaliseAt is like Finalise, but also marks each input as cleared at t, so
+// that estimates treat the newly finalised history as having been observed
+// at t.
+func (o *OPIC) FinaliseAt(in []string, t time.Time) {
+	ids := o.hashList(in)
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.finalise(ids)
+
+	for _, k := range ids {
+		o.cleared[k] = t
+	}
+}
+
+// finalise is the implementation of Finalise. It must be called with the
+// write lock held.
+func (o *OPIC) finalise(in []uint64) {
+	for _, inH := range in {
+		o.emit(EventFinalise, inH, o.current[inH])
+		o.history[inH] = o.current[inH]
+		o.current[inH] = 0
+	}
+
+	if len(in) > 0 {
+		o.changed()
+	}
+}
+
+// FinaliseWhere is like Finalise, but operates on every entry for which pred
+// returns true instead of an explicit list. The virtual entry is never
+// offered to pred. It returns the number of entries finalised and the total
+// cash moved into their history. pred runs with the write lock held, so it
+// must not call back into the OPIC instance or it will deadlock.
+func (o *OPIC) FinaliseWhere(pred func(key uint64, current float64, cleared time.Time) bool) (int, float64) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	var n int
+	var total float64
+
+	for k, c := range o.current {
+		if k == 0 || !pred(k, c, o.cleared[k]) {
+			continue
+		}
+
+		o.history[k] = c
+		o.current[k] = 0
+
+		o.emit(EventFinalise, k, c)
+
+		n++
+		total += c
+	}
+
+	if n > 0 {
+		o.changed()
+	}
+
+	return n, total
+}
+
+// FinaliseFraction is a softer form of Finalise. Rather than replacing the
+// history of each input with all of its current cash, it moves fraction of
+// the current cash into the history, adding to what's already there, and
+// leaves the rest to carry over into the next cycle. Each input is marked as
+// cleared at t. The fraction is clamped to [0, 1]. With a fraction of 1 this
+// behaves like Finalise, except that history accumulates instead of being
+// replaced.
+func (o *OPIC) FinaliseFraction(in []string, fraction float64, t time.Time) {
+	if fraction < 0 || math.IsNaN(fraction) {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	for _, s := range in {
+		inH := o.hash(s)
+
+		m := o.current[inH] * fraction
+
+		o.history[inH] = o.history[inH] + m
+		o.current[inH] = o.current[inH] - m
+		o.cleared[inH] = t
+
+		o.emit(EventFinalise, inH, m)
+	}
+
+	if len(in) > 0 {
+		o.changed()
+	}
+}
+
+// SetEvictionCallback sets a function to be called for every entry that's
+// evicted automatically, e.g. by compaction, so that it can be archived
+// rather than lost. Entries removed explicitly don't trigger it. The callback
+// runs with the write lock held, so it must not call back into the OPIC
+// instance or it will deadlock. Passing nil removes the callback.
+func (o *OPIC) SetEvictionCallback(fn func(key uint64, current, history float64)) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.onEvict = fn
+}
+
+// RemoveN deletes an entry, referenced by numeric hash, entirely. Its cash
+// goes to the virtual entry so that the system's total is unchanged, and the
+// amount of current cash moved is returned. The virtual entry itself can't
+// be removed.
+func (o *OPIC) RemoveN(v uint64) float64 {
+	if v == 0 {
+		return 0
+	}
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	return o.remove(v)
+}
+
+// remove is the implementation of RemoveN. It must be called with the write
+// lock held.
+func (o *OPIC) remove(v uint64) float64 {
+	c, h := o.drop(v)
+
+	o.current[0] = o.current[0] + c
+	o.history[0] = o.history[0] + h
+
+	o.emit(EventDelete, v, c)
+
+	o.changed()
+
+	return c
+}
+
+// Remove deletes an entry entirely. See RemoveN.
+func (o *OPIC) Remove(s string) float64 {
+	return o.RemoveN(o.hash(s))
+}
+
+// drop deletes an entry from all of the internal maps, returning its current
+// and history values. It must be called with the write lock held.
+func (o *OPIC) drop(v uint64) (float64, float64) {
+	o.notePeaks()
+
+	c, h := o.current[v], o.history[v]
+
+	delete(o.current, v)
+	delete(o.history, v)
+	delete(o.cleared, v)
+	delete(o.intervals, v)
+	delete(o.urls, v)
+
+	return c, h
+}
+
+// notePeaks updates the high water marks of the internal maps. It must be
+// called with the write lock held, before anything is deleted from them.
+func (o *OPIC) notePeaks() {
+	if len(o.current) > o.currentPeak {
+		o.currentPeak = len(o.current)
+	}
+	if len(o.history) > o.historyPeak {
+		o.historyPeak = len(o.history)
+	}
+	if len(o.cleared) > o.clearedPeak {
+		o.clearedPeak = len(o.cleared)
+	}
+}
+
+// evict drops an entry and tells the eviction callback about it. It must be
+// called with the write lock held.
+func (o *OPIC) evict(v uint64) (float64, float64) {
+	c, h := o.drop(v)
+
+	if o.onEvict != nil {
+		o.onEvict(v, c, h)
+	}
+
+	o.emit(EventEvict, v, c)
+
+	return c, h
+}
+
+// ResetHistoryN clears the history of an entry, referenced by numeric hash,
+// leaving its current cash and cleared time alone. It's for correcting a
+// single entry whose history no longer means anything, e.g. because the page
+// has fundamentally changed.
+func (o *OPIC) ResetHistoryN(v uint64) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if _, ok := o.history[v]; !ok {
+		return
+	}
+
+	o.history[v] = 0
+
+	o.changed()
+}
+
+// ResetHistory clears the history of an entry.
+func (o *OPIC) ResetHistory(s string) {
+	o.ResetHistoryN(o.hash(s))
+}
+
+// DecayHistory multiplies every history value by factor, so that old
+// importance fades even for entries that aren't being distributed to any
+// more. The virtual entry is only included if virtual is true. The factor
+// must be in (0, 1); anything else, including 1 itself, is a request to do
+// nothing.
+func (o *OPIC) DecayHistory(factor float64, virtual bool) {
+	if !(factor > 0) || factor >= 1 {
+		return
+	}
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	var decayed bool
+	for k, h := range o.history {
+		if (k != 0 || virtual) && h != 0 {
+			o.history[k] = h * factor
+			decayed = true
+		}
+	}
+
+	if decayed {
+		o.changed()
+	}
+}
+
+// Decay is DecayHistory including the virtual entry, so that the history
+// total shrinks by exactly factor, for running on a schedule.
+func (o *OPIC) Decay(factor float64) {
+	o.DecayHistory(factor, true)
+}
+
+// ReconcileReport describes the inconsistencies fixed by Reconcile.
+type ReconcileReport struct {
+	// MissingCurrent is the number of keys given a zero current value.
+	MissingCurrent int
+	// MissingHistory is the number of keys given a zero history value.
+	MissingHistory int
+}
+
+// Total returns the total number of inconsistencies fixed.
+func (r ReconcileReport) Total() int {
+	return r.MissingCurrent + r.MissingHistory
+}
+
+// Reconcile makes sure that every key known to any of the internal maps has
+// an explicit current and history value, filling in zero where they're
+// missing. This can drift after partial operations or merges. Keys that have
+// never been fetched are left without a cleared time, since an absent time
+// already means exactly that.
+func (o *OPIC) Reconcile() ReconcileReport {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	return o.reconcile()
+}
+
+// reconcile is the implementation of Reconcile. It must be called with the
+// write lock held.
+func (o *OPIC) reconcile() ReconcileReport {
+	var r ReconcileReport
+
+	fill := func(k uint64) {
+		if _, ok := o.current[k]; !ok {
+			o.current[k] = 0
+			r.MissingCurrent++
+		}
+		if _, ok := o.history[k]; !ok {
+			o.history[k] = 0
+			r.MissingHistory++
+		}
+	}
+
+	for k := range o.current {
+		fill(k)
+	}
+	for k := range o.history {
+		fill(k)
+	}
+	for k := range o.cleared {
+		fill(k)
+	}
+
+	if r.Total() > 0 {
+		o.changed()
+	}
+
+	return r
+}
+
+// GetN gets the details for an entry, referenced by numeric hash.
+func (o *OPIC) GetN(v uint64) (float64, float64, time.Time) {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	return o.history[v], o.current[v], o.cleared[v]
+}
+
+// GetNV gets the details for a list of entries, referenced by numeric hash,
+// under a single acquisition of the read lock. The results are in the same
+// order as v. An entry that doesn't exist comes back with its Hash filled in
+// and everything else zero, just as GetN would return it; use ContainsN to
+// tell it apart from one that exists but has no cash.
+func (o *OPIC) GetNV(v []uint64) []Entry {
+	r := make([]Entry, len(v))
+
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	for i, k := range v {
+		r[i] = o.entry(k)
+	}
+
+	return r
+}
+
+// GetV gets the details for a list of entries. See GetNV.
+func (o *OPIC) GetV(v []string) []Entry {
+	return o.GetNV(o.hashList(v))
+}
+
+// GetEstimateNV is GetNV and EstimateNV together, under a single acquisition
+// of the read lock, so that the details and the estimates all come from the
+// same state. The results are in the same order as v.
+func (o *OPIC) GetEstimateNV(v []uint64, interval time.Duration, t time.Time) ([]Entry, []float64) {
+	entries := make([]Entry, len(v))
+	estimates := make([]float64, len(v))
+
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	for i, k := range v {
+		entries[i] = o.entry(k)
+		estimates[i] = o.estimate(k, interval, t)
+	}
+
+	return entries, estimates
+}
+
+// GetEstimateV gets the details and estimates for a list of entries. See
+// GetEstimateNV.
+func (o *OPIC) GetEstimateV(v []string, interval time.Duration, t time.Time) ([]Entry, []float64) {
+	return o.GetEstimateNV(o.hashList(v), interval, t)
+}
+
+// ContainsN reports whether an entry, referenced by numeric hash, has a
+// current value, which distinguishes an entry that has never been seen from
+// one that's been seen but has no cash. The virtual entry doesn't count.
+func (o *OPIC) ContainsN(v uint64) bool {
+	if v == 0 {
+		return false
+	}
+
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	_, ok := o.current[v]
+
+	return ok
+}
+
+// ClearedBetween returns the keys of every entry cleared at or after from and
+// before to, ordered by cleared time and then key. Entries that have never
+// been cleared are never included. Feeding the previous to back in as the
+// next from gives an incremental "everything fetched since last time" feed.
+func (o *OPIC) ClearedBetween(from, to time.Time) []uint64 {
+	o.m.RLock()
+	var r []uint64
+	for k, t := range o.cleared {
+		if !t.IsZero() && !t.Before(from) && t.Before(to) {
+			r = append(r, k)
+		}
+	}
 
-	dirty bool
+	sort.Slice(r, func(i, j int) bool {
+		ti, tj := o.cleared[r[i]], o.cleared[r[j]]
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return r[i] < r[j]
+	})
+	o.m.RUnlock()
 
-	current map[uint64]float64
-	cleared map[uint64]time.Time
-	history map[uint64]float64
+	return r
 }
 
-// New constructs a new OPIC object.
-func New() *OPIC {
-	return &OPIC{
-		current: make(map[uint64]float64),
-		cleared: make(map[uint64]time.Time),
-		history: make(map[uint64]float64),
-	}
+// EstimateN estimates the total for an entry, referenced by numeric hash. If
+// the entry has an interval of its own (see SetIntervalN), that's used
+// instead of interval. If the interval isn't positive, the estimate is just
+// the entry's current cash. If t is before the entry was last cleared, it's
+// treated as if it had just been cleared, i.e. the estimate is history plus
+// current.
+func (o *OPIC) EstimateN(v uint64, interval time.Duration, t time.Time) float64 {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	return o.estimate(v, interval, t)
 }
 
-// InitialiseN sets the total cash for the system, and distributes it evenly
-// amongst a collection of URLs referenced by numeric hash.
-func (o *OPIC) InitialiseN(cash float64, in []uint64) {
+// EstimateWithIntervalN is like EstimateN, but always uses interval, even if
+// the entry has an interval of its own.
+func (o *OPIC) EstimateWithIntervalN(v uint64, interval time.Duration, t time.Time) float64 {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	return o.estimateWith(v, interval, t)
+}
+
+// EstimateWithInterval is like Estimate, but always uses interval. See
+// EstimateWithIntervalN.
+func (o *OPIC) EstimateWithInterval(s string, interval time.Duration, t time.Time) float64 {
+	return o.EstimateWithIntervalN(o.hash(s), interval, t)
+}
+
+// SetIntervalN gives an entry, referenced by numeric hash, an interval of its
+// own, for parts of a site that change much more or less often than the
+// rest. The Estimate family of methods use it in place of the interval they're
+// given. An interval that isn't positive removes the entry's own interval.
+// Intervals are saved along with the rest of the state, and are forgotten
+// when the entry is removed.
+func (o *OPIC) SetIntervalN(v uint64, interval time.Duration) {
 	o.m.Lock()
 	defer o.m.Unlock()
 
-	n := cash / float64(len(in))
+	if interval <= 0 {
+		if _, ok := o.intervals[v]; ok {
+			delete(o.intervals, v)
+			o.changed()
+		}
 
-	for _, u := range in {
-		o.current[u] = n
+		return
 	}
 
-	o.dirty = true
+	if i, ok := o.intervals[v]; ok && i == interval {
+		return
+	}
+
+	if o.intervals == nil {
+		o.intervals = make(map[uint64]time.Duration)
+	}
+
+	o.intervals[v] = interval
+
+	o.changed()
 }
 
-// Initialise sets the total cash for the system, and distributes it evenly
-// amongst a collection of URLs.
-func (o *OPIC) Initialise(cash float64, in []string) {
-	ids := make([]uint64, len(in))
-	for i, s := range in {
-		ids[i] = fnvHash(s)
+// SetInterval gives an entry an interval of its own. See SetIntervalN.
+func (o *OPIC) SetInterval(s string, interval time.Duration) {
+	o.SetIntervalN(o.hash(s), interval)
+}
+
+// estimate is the implementation of EstimateN. It must be called with at
+// least the read lock held.
+func (o *OPIC) estimate(v uint64, interval time.Duration, t time.Time) float64 {
+	if d, ok := o.intervals[v]; ok {
+		interval = d
 	}
 
-	o.InitialiseN(cash, ids)
+	return o.estimateWith(v, interval, t)
 }
 
-// Distribute distributes the cash from the input to the outputs, and marks
-// the input as having been fetched.
-func (o *OPIC) Distribute(source string, out []string, t time.Time) float64 {
+// estimateWith is the implementation of EstimateWithIntervalN. It must be
+// called with at least the read lock held.
+func (o *OPIC) estimateWith(v uint64, interval time.Duration, t time.Time) float64 {
+	h, hok := o.history[v]
+	c, cok := o.current[v]
+	vt, tok := o.cleared[v]
+	if !hok && !cok && !tok {
+		return o.unseen
+	}
+	if o.expired(v, t) {
+		return 0
+	}
+
+	// without an interval there's no window to spread the history over, and
+	// the model would have to divide by zero
+	if interval <= 0 {
+		return c
+	}
+
+	// t can be before the entry was cleared when events are replayed out of
+	// order; treat it as having only just been cleared
+	d := t.Sub(vt)
+	if d < 0 {
+		d = 0
+	}
+
+	return o.model.Estimate(h, c, d, interval)
+}
+
+// SetUnseenEstimate sets the value returned by the Estimate family of
+// methods for keys that aren't present at all, i.e. that have no current,
+// history, or cleared value. It defaults to zero. Setting it above zero gives
+// never-seen URLs an "exploration bonus" over known ones with little cash.
+func (o *OPIC) SetUnseenEstimate(v float64) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.unseen = v
+}
+
+// SetTTL sets how long an entry stays relevant after it was last cleared.
+// Once cleared+ttl is before the time being asked about, the entry is
+// expired: it estimates as zero and is left out of rankings. Expired entries
+// keep their cash, so a later distribution to or from them brings them back,
+// until CompactExpired reclaims it. Entries that have never been cleared
+// never expire. The default of zero disables expiry.
+func (o *OPIC) SetTTL(d time.Duration) {
 	o.m.Lock()
 	defer o.m.Unlock()
 
-	sourceH := fnvHash(source)
+	o.ttl = d
+}
 
-	c := o.current[sourceH]
+// expired reports whether an entry has outlived the TTL as of t. It must be
+// called with at least the read lock held.
+func (o *OPIC) expired(v uint64, t time.Time) bool {
+	if o.ttl <= 0 || v == 0 {
+		return false
+	}
 
-	o.current[0] = o.current[0] + c/float64(len(out)+1)
+	vt, ok := o.cleared[v]
 
-	for _, s := range out {
-		outH := fnvHash(s)
-		o.current[outH] = o.current[outH] + c/float64(len(out)+1)
-		if _, ok := o.cleared[outH]; !ok {
-			o.cleared[outH] = time.Now()
+	return ok && !vt.IsZero() && vt.Add(o.ttl).Before(t)
+}
+
+// CompactExpired evicts every entry that's expired as of t, returning how
+// many were evicted. Their cash goes to the virtual entry, so the system's
+// total is unchanged, and the eviction callback is told about each of them.
+func (o *OPIC) CompactExpired(t time.Time) int {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if o.ttl <= 0 {
+		return 0
+	}
+
+	var n int
+	for k := range o.cleared {
+		if !o.expired(k, t) {
+			continue
 		}
+
+		c, h := o.evict(k)
+		o.current[0] = o.current[0] + c
+		o.history[0] = o.history[0] + h
+
+		n++
 	}
 
-	d := o.current[0] / float64(len(o.current)+1)
-	o.current[0] = o.current[0] - d
+	if n > 0 {
+		o.changed()
+	}
 
-	o.current[sourceH] = d
-	o.cleared[sourceH] = t
-	o.history[sourceH] = c
+	return n
+}
 
-	o.dirty = true
+// Prune evicts every entry whose current cash is below threshold, returning
+// how many were evicted. It's for clearing out the long tail of entries left
+// with tiny residual cash. Their cash goes to the virtual entry, so the
+// system's total is unchanged, and the eviction callback is told about each
+// of them.
+func (o *OPIC) Prune(threshold float64) int {
+	return o.prune(func(history, current float64, cleared time.Time) bool {
+		return current < threshold
+	})
+}
 
-	return c
+// PruneWithHistory is like Prune, but only evicts entries whose history is
+// also below threshold, so that entries that have been important in the past
+// are kept.
+func (o *OPIC) PruneWithHistory(threshold float64) int {
+	return o.prune(func(history, current float64, cleared time.Time) bool {
+		return current < threshold && history < threshold
+	})
 }
 
-// Finalise moves all the current values into the history for the inputs.
-func (o *OPIC) Finalise(in []string) {
+// PruneOlderThan evicts every entry last fetched before cutoff, returning how
+// many were evicted, to keep the working set from growing without bound.
+// Entries that have never been fetched are always kept, since there's no way
+// to tell how stale they are. Like Prune, their cash goes to the virtual
+// entry and the eviction callback is told about each of them.
+func (o *OPIC) PruneOlderThan(cutoff time.Time) int {
+	return o.prune(func(history, current float64, cleared time.Time) bool {
+		return !cleared.IsZero() && cleared.Before(cutoff)
+	})
+}
+
+// prune evicts every entry other than the virtual one for which pred returns
+// true, moving its cash to the virtual entry.
+func (o *OPIC) prune(pred func(history, current float64, cleared time.Time) bool) int {
 	o.m.Lock()
 	defer o.m.Unlock()
 
-	for _, s := range in {
-		inH := fnvHash(s)
-		o.history[inH] = o.current[inH]
-		o.current[inH] = 0
-	}
+	var n int
 
-	o.dirty = true
-}
+	check := func(k uint64) {
+		if k == 0 || !pred(o.history[k], o.current[k], o.cleared[k]) {
+			return
+		}
 
-// GetN gets the details for an entry, referenced by numeric hash.
-func (o *OPIC) GetN(v uint64) (float64, float64, time.Time) {
-	o.m.RLock()
-	defer o.m.RUnlock()
+		c, h := o.evict(k)
+		o.current[0] = o.current[0] + c
+		o.history[0] = o.history[0] + h
 
-	return o.history[v], o.current[v], o.cleared[v]
-}
+		n++
+	}
 
-// EstimateN estimates the total for an entry, referenced by numeric hash.
-func (o *OPIC) EstimateN(v uint64, interval time.Duration, t time.Time) float64 {
-	h, c, vt := o.GetN(v)
-	d := t.Sub(vt)
+	// evicting an entry removes it from all of the maps, so nothing is
+	// checked twice
+	for k := range o.current {
+		check(k)
+	}
+	for k := range o.history {
+		check(k)
+	}
+	for k := range o.cleared {
+		check(k)
+	}
 
-	var r float64
-	if d < interval {
-		r = h*(float64(interval)-float64(d))/float64(interval) + c
-	} else {
-		r = c * (float64(interval) / float64(d))
+	if n > 0 {
+		o.changed()
 	}
 
-	return r
+	return n
 }
 
 // EstimateNV estimates the total for a list of entries, referenced by numeric
@@ -141,12 +1449,17 @@ func (o *OPIC) EstimateNV(v []uint64, interval time.Duration, t time.Time) []flo
 
 // Get gets the details for an entry.
 func (o *OPIC) Get(s string) (float64, float64, time.Time) {
-	return o.GetN(fnvHash(s))
+	return o.GetN(o.hash(s))
+}
+
+// Contains reports whether an entry has a current value. See ContainsN.
+func (o *OPIC) Contains(s string) bool {
+	return o.ContainsN(o.hash(s))
 }
 
 // Estimate estimates the total for an entry.
 func (o *OPIC) Estimate(s string, interval time.Duration, t time.Time) float64 {
-	return o.EstimateN(fnvHash(s), interval, t)
+	return o.EstimateN(o.hash(s), interval, t)
 }
 
 // EstimateV estimates the totals for a list of entries.
@@ -160,22 +1473,212 @@ func (o *OPIC) EstimateV(v []string, interval time.Duration, t time.Time) []floa
 	return r
 }
 
+// ForEach calls fn for every entry except the virtual one, in no particular
+// order, stopping early if fn returns false. It holds the read lock
+// throughout, so fn must not call any methods that modify the instance, and
+// nothing else can modify it until ForEach returns.
+func (o *OPIC) ForEach(fn func(hash uint64, history, current float64, cleared time.Time) bool) {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	for k, c := range o.current {
+		if k != 0 && !fn(k, o.history[k], c, o.cleared[k]) {
+			return
+		}
+	}
+	for k, h := range o.history {
+		if _, ok := o.current[k]; ok || k == 0 {
+			continue
+		}
+		if !fn(k, h, 0, o.cleared[k]) {
+			return
+		}
+	}
+	for k, t := range o.cleared {
+		_, cok := o.current[k]
+		_, hok := o.history[k]
+		if cok || hok || k == 0 {
+			continue
+		}
+		if !fn(k, 0, 0, t) {
+			return
+		}
+	}
+}
+
+// Keys returns a copy of the keys of every entry with a current value, not
+// including the virtual entry, in no particular order.
+func (o *OPIC) Keys() []uint64 {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	r := make([]uint64, 0, len(o.current))
+	for k := range o.current {
+		if k != 0 {
+			r = append(r, k)
+		}
+	}
+
+	return r
+}
+
+// Len returns the number of entries with a current value, not counting the
+// virtual entry.
+func (o *OPIC) Len() int {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	n := len(o.current)
+	if _, ok := o.current[0]; ok {
+		n--
+	}
+
+	return n
+}
+
+// HistoryLen returns the number of entries with a history value, not counting
+// the virtual entry. Comparing it to Len shows how much of the set has been
+// finalised.
+func (o *OPIC) HistoryLen() int {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	n := len(o.history)
+	if _, ok := o.history[0]; ok {
+		n--
+	}
+
+	return n
+}
+
+// EstimateVParallel is like EstimateV, but spreads the work across workers
+// goroutines, for ranking large batches. If workers isn't positive, it uses
+// GOMAXPROCS. The read lock is taken once for the whole batch rather than
+// once per entry, so writers wait until the batch is done. The results are
+// in the same order as v.
+func (o *OPIC) EstimateVParallel(v []string, interval time.Duration, t time.Time, workers int) []float64 {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(v) {
+		workers = len(v)
+	}
+
+	r := make([]float64, len(v))
+
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			// each worker takes a contiguous chunk, so they don't share
+			// cache lines in r
+			from, to := len(v)*w/workers, len(v)*(w+1)/workers
+			for i := from; i < to; i++ {
+				r[i] = o.estimate(o.hash(v[i]), interval, t)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	return r
+}
+
 // Dirty returns true if there have been any changes since the last time the
 // OPIC instance was loaded or saved. It's intended that this be used by the
 // persistency layer to decide what to do.
 func (o *OPIC) Dirty() bool {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
 	return o.dirty
 }
 
 // EnsureBalance "tops up" the cash in the system, allowing the user to
-// correct for slight inaccuracies in floating point math.
+// correct for slight inaccuracies in floating point math. If there's already
+// at least n, nothing is changed.
 func (o *OPIC) EnsureBalance(n float64) {
-	r1, r2 := o.Sums()
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	r1, r2 := o.sums()
 	if (r1 + r2) < n {
 		o.current[0] = o.current[0] + (n - (r1 + r2))
+		o.emit(EventRebalance, 0, n-(r1+r2))
+
+		o.changed()
+	}
+}
+
+// FlushVirtual hands the virtual entry's current cash out evenly to every
+// other entry, which is the teleportation step of OPIC done explicitly. The
+// virtual entry otherwise only gives its cash back a little at a time as
+// sources are fetched, so flushing it periodically speeds up convergence.
+// Whatever can't be split exactly stays with the virtual entry, so the total
+// is unchanged.
+func (o *OPIC) FlushVirtual() {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	n := len(o.current)
+	if _, ok := o.current[0]; ok {
+		n--
+	}
+	if n == 0 || o.current[0] == 0 {
+		return
 	}
 
-	o.dirty = true
+	v := o.current[0]
+	share := v / float64(n)
+
+	var given float64
+	for k, c := range o.current {
+		if k != 0 {
+			o.current[k] = c + share
+			given += share
+		}
+	}
+
+	o.current[0] = v - given
+
+	o.emit(EventRebalance, 0, given)
+
+	o.changed()
+}
+
+// Normalise scales every current value, including the virtual entry's, so
+// that they add up to target, keeping their proportions. Any rounding error
+// left over after scaling goes to the virtual entry, so the sum comes out at
+// exactly target. History is left alone. It does nothing if there's no
+// current cash to scale.
+func (o *OPIC) Normalise(target float64) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	_, sum := o.sums()
+	if sum == 0 || math.IsNaN(sum) || math.IsInf(sum, 0) {
+		return
+	}
+
+	f := target / sum
+
+	var given float64
+	for k, c := range o.current {
+		if k != 0 {
+			o.current[k] = c * f
+			given += c * f
+		}
+	}
+
+	o.current[0] = target - given
+
+	o.emit(EventRebalance, 0, target-sum)
+
+	o.changed()
 }
 
 // Virtual gets the details for the "virtual" entry.
@@ -193,6 +1696,25 @@ func (o *OPIC) Sums() (float64, float64) {
 	o.m.RLock()
 	defer o.m.RUnlock()
 
+	return o.sums()
+}
+
+// Drift returns how far apart the two totals from Sums have drifted, as
+// history minus current, along with the totals themselves, all from a single
+// pass. Watching it grow over a crawl gives a threshold for when to call
+// EnsureBalance or Normalise.
+func (o *OPIC) Drift() (float64, float64, float64) {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	h, c := o.sums()
+
+	return h - c, h, c
+}
+
+// sums is the implementation of Sums. It must be called with at least the
+// read lock held.
+func (o *OPIC) sums() (float64, float64) {
 	var r1, r2 float64
 	for _, v := range o.history {
 		r1 += v
@@ -202,3 +1724,125 @@ func (o *OPIC) Sums() (float64, float64) {
 	}
 	return r1, r2
 }
+
+// sortedKeys returns every key known to any of the internal maps, in
+// ascending order. It must be called with at least the read lock held.
+func (o *OPIC) sortedKeys() []uint64 {
+	r := make([]uint64, 0, len(o.current))
+	for k := range o.current {
+		r = append(r, k)
+	}
+	for k := range o.history {
+		if _, ok := o.current[k]; !ok {
+			r = append(r, k)
+		}
+	}
+	for k := range o.cleared {
+		_, cok := o.current[k]
+		_, hok := o.history[k]
+		if !cok && !hok {
+			r = append(r, k)
+		}
+	}
+	for k := range o.intervals {
+		_, cok := o.current[k]
+		_, hok := o.history[k]
+		_, tok := o.cleared[k]
+		if !cok && !hok && !tok {
+			r = append(r, k)
+		}
+	}
+
+	sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
+
+	return r
+}
+
+// ContentHash returns a hash identifying the exact state, including which
+// maps each key is present in. Entries are hashed in key order, so two
+// identical states always have the same hash regardless of how they were
+// built. This is O(n log n) in the number of entries.
+func (o *OPIC) ContentHash() uint64 {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	h := fnv.New64()
+
+	var b [8]byte
+	put := func(v uint64) {
+		binary.BigEndian.PutUint64(b[:], v)
+		h.Write(b[:])
+	}
+
+	for _, k := range o.sortedKeys() {
+		put(k)
+
+		if c, ok := o.current[k]; ok {
+			put(1)
+			put(math.Float64bits(c))
+		} else {
+			put(0)
+		}
+
+		if v, ok := o.history[k]; ok {
+			put(1)
+			put(math.Float64bits(v))
+		} else {
+			put(0)
+		}
+
+		if t, ok := o.cleared[k]; ok {
+			put(1)
+			put(uint64(t.Unix()))
+			put(uint64(t.Nanosecond()))
+		} else {
+			put(0)
+		}
+
+		if d, ok := o.intervals[k]; ok {
+			put(1)
+			put(uint64(d))
+		} else {
+			put(0)
+		}
+	}
+
+	return h.Sum64()
+}
+
+// Entry is a copy of everything known about a single key.
+type Entry struct {
+	Hash    uint64
+	History float64
+	Current float64
+	Cleared time.Time
+	// Interval is the entry's own interval (see SetIntervalN), or zero if it
+	// uses the one passed to Estimate.
+	Interval time.Duration
+}
+
+// entry copies everything known about a key into an Entry. It must be called
+// with at least the read lock held.
+func (o *OPIC) entry(k uint64) Entry {
+	return Entry{Hash: k, History: o.history[k], Current: o.current[k], Cleared: o.cleared[k], Interval: o.intervals[k]}
+}
+
+// SortedEntries returns a copy of every entry except the virtual one, in
+// ascending key order, so that callers can binary search it or iterate it
+// deterministically. It's a snapshot: later changes to the instance aren't
+// reflected in it. Building it is O(n log n) in the number of entries.
+func (o *OPIC) SortedEntries() []Entry {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	keys := o.sortedKeys()
+
+	r := make([]Entry, 0, len(keys))
+	for _, k := range keys {
+		if k != 0 {
+			r = append(r, o.entry(k))
+		}
+	}
+
+	return r
+}
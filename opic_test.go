@@ -0,0 +1,962 @@
+package opic
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestDistributeRoundTrip(t *testing.T) {
+	a := &Serialisable{OPIC: New()}
+	a.Initialise(1, []string{"a", "b", "c"})
+
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	a.Distribute("a", []string{"b", "c"}, ts)
+
+	var buf bytes.Buffer
+	if _, err := a.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Serialisable{OPIC: New()}
+	if _, err := b.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []string{"a", "b", "c"} {
+		ah, ac, at := a.Get(u)
+		bh, bc, bt := b.Get(u)
+
+		if ah != bh || ac != bc {
+			t.Errorf("%s: expected history %v and current %v but got %v and %v", u, ah, ac, bh, bc)
+		}
+		if !at.Equal(bt) {
+			t.Errorf("%s: expected cleared %v but got %v", u, at, bt)
+		}
+	}
+
+	if _, _, at := b.Get("a"); !at.Equal(ts) {
+		t.Errorf("expected the source to be cleared at %v but got %v", ts, at)
+	}
+}
+
+// TestDriftGrowth logs how Drift, and the rounding error in the current total
+// that EnsureBalance corrects, grow over a long run of random distributions,
+// for choosing when to call EnsureBalance or Normalise. Drift itself is mostly
+// the gap between the cash handed out and the history recorded for it, which
+// settles once every page has been fetched a few times; it's the rounding
+// error that keeps growing.
+func TestDriftGrowth(t *testing.T) {
+	const pages = 1000
+
+	n := 1000000
+	if testing.Short() {
+		n = 10000
+	}
+
+	rng := rand.New(rand.NewSource(1))
+
+	urls := make([]string, pages)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://example.com/%d", i)
+	}
+
+	o := New()
+	o.Initialise(1, urls)
+
+	ts := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var out []string
+	for i, next := 1, 10; i <= n; i++ {
+		out = out[:0]
+		for j := rng.Intn(20); j > 0; j-- {
+			out = append(out, urls[rng.Intn(pages)])
+		}
+
+		o.Distribute(urls[rng.Intn(pages)], out, ts.Add(time.Duration(i)*time.Second))
+
+		if i == next {
+			d, h, c := o.Drift()
+			t.Logf("%8d distributions: drift %.3g, history %.17g, current %.17g, current error %.3g", i, d, h, c, c-1)
+
+			if d != h-c {
+				t.Fatalf("drift %v isn't history %v minus current %v", d, h, c)
+			}
+
+			// rounding error grows with roughly the square root of the number
+			// of distributions, and is nowhere near this
+			if e := math.Abs(c - 1); e > 1e-12 {
+				t.Errorf("current total is off by %v after %d distributions", e, i)
+			}
+
+			next *= 10
+		}
+	}
+}
+
+func TestIntervalEstimates(t *testing.T) {
+	o := New()
+	o.Initialise(1, []string{"hourly", "yearly"})
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	o.Distribute("hourly", nil, t0)
+	o.Distribute("yearly", nil, t0)
+
+	o.SetInterval("hourly", time.Hour)
+	o.SetInterval("yearly", time.Hour*24*365)
+
+	hh, hc, _ := o.Get("hourly")
+	yh, yc, _ := o.Get("yearly")
+
+	expected := []struct {
+		url      string
+		elapsed  time.Duration
+		estimate float64
+	}{
+		// half way through its interval, the hourly entry has lost half of
+		// its history, while the yearly one has barely lost any
+		{"hourly", time.Minute * 30, hh/2 + hc},
+		{"yearly", time.Minute * 30, yh*(1-float64(time.Minute*30)/float64(time.Hour*24*365)) + yc},
+		// twice its interval on, the hourly entry's current cash is halved
+		{"hourly", time.Hour * 2, hc / 2},
+		{"yearly", time.Hour * 24 * 365 / 2, yh/2 + yc},
+	}
+
+	for _, e := range expected {
+		if v := o.Estimate(e.url, time.Hour*24, t0.Add(e.elapsed)); math.Abs(v-e.estimate) > 1e-15 {
+			t.Errorf("%s after %v: expected %v but got %v", e.url, e.elapsed, e.estimate, v)
+		}
+	}
+
+	// the interval passed in is only used by entries without their own
+	if a, b := o.EstimateWithInterval("hourly", time.Hour*24, t0.Add(time.Hour*12)), hh/2+hc; math.Abs(a-b) > 1e-15 {
+		t.Errorf("expected %v with the interval overridden but got %v", b, a)
+	}
+}
+
+func TestIntervalsSurviveSerialisers(t *testing.T) {
+	a := &Serialisable{OPIC: New()}
+	a.Initialise(1, []string{"a", "b"})
+	a.Distribute("a", []string{"b"}, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	before := a.ContentHash()
+	a.SetInterval("a", time.Hour)
+	a.SetInterval("unseen", time.Minute)
+	if a.ContentHash() == before {
+		t.Errorf("setting an interval didn't change the content hash")
+	}
+
+	at := time.Date(2020, 1, 1, 0, 30, 0, 0, time.UTC)
+	estimate := a.Estimate("a", time.Hour*24, at)
+
+	check := func(name string, b *Serialisable) {
+		t.Helper()
+
+		// storage fills in zeros for missing values, so only the intervals
+		// themselves can be compared
+		if name == "storage" {
+			for _, e := range b.GetV([]string{"a", "unseen"}) {
+				if e.Interval == 0 {
+					t.Errorf("%s: lost the interval of %d", name, e.Hash)
+				}
+			}
+		} else if a.ContentHash() != b.ContentHash() {
+			t.Errorf("%s: content hash changed in round trip", name)
+		}
+		if v := b.Estimate("a", time.Hour*24, at); v != estimate {
+			t.Errorf("%s: expected estimate %v but got %v", name, estimate, v)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := a.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b := &Serialisable{OPIC: New()}
+	if _, err := b.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	check("binary", b)
+
+	d, err := a.MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = &Serialisable{OPIC: New()}
+	if err := b.UnmarshalProto(d); err != nil {
+		t.Fatal(err)
+	}
+	check("proto", b)
+
+	d, err = a.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = &Serialisable{OPIC: New()}
+	if err := b.UnmarshalJSON(d); err != nil {
+		t.Fatal(err)
+	}
+	check("json", b)
+
+	st := NewMapStorage()
+	if err := a.WriteStorage(st); err != nil {
+		t.Fatal(err)
+	}
+	b = &Serialisable{OPIC: New()}
+	if err := b.ReadStorage(st); err != nil {
+		t.Fatal(err)
+	}
+	check("storage", b)
+	if !b.Dirty() {
+		t.Errorf("expected reading from storage to mark the state dirty")
+	}
+
+	var found bool
+	for _, e := range a.Diff(New()) {
+		if e.Hash == a.hash("a") {
+			found = e.Interval == time.Hour
+		}
+	}
+	if !found {
+		t.Errorf("diff didn't report the interval")
+	}
+
+	buf.Reset()
+	if err := a.ExportCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(",1h0m0s\n")) {
+		t.Errorf("exported CSV doesn't include the interval:\n%s", buf.Bytes())
+	}
+}
+
+func TestURLsSurviveSerialisation(t *testing.T) {
+	a := &Serialisable{OPIC: New()}
+	a.SetTrackURLs(true)
+	a.Initialise(1, []string{"http://a/", "http://b/"})
+	a.Distribute("http://a/", []string{"http://b/", "http://c/"}, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	var buf bytes.Buffer
+	if _, err := a.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Serialisable{OPIC: New()}
+	b.SetTrackURLs(true)
+	_, report, err := b.ReadFromWithOptions(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.URLCount != 3 {
+		t.Errorf("expected 3 URLs to be read but got %d", report.URLCount)
+	}
+	for _, s := range []string{"http://a/", "http://b/", "http://c/"} {
+		if u, ok := b.URL(b.hash(s)); !ok || u != s {
+			t.Errorf("expected %q to be read back but got %q", s, u)
+		}
+	}
+	if b.ContentHash() != a.ContentHash() {
+		t.Errorf("expected the rest of the state to be read back too")
+	}
+
+	// without tracking, the URLs are skipped over
+	c := &Serialisable{OPIC: New()}
+	if _, err := c.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.URL(c.hash("http://a/")); ok {
+		t.Errorf("expected URLs not to be kept without tracking")
+	}
+	if c.ContentHash() != a.ContentHash() {
+		t.Errorf("expected the rest of the state to be read back without tracking")
+	}
+}
+
+func TestDistributeStampsNewOutputs(t *testing.T) {
+	past := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+
+	o := New()
+	o.Initialise(1, []string{"a", "b"})
+	o.Distribute("b", nil, past.Add(-time.Hour))
+	o.Distribute("a", []string{"b", "x", "y"}, past)
+
+	for _, s := range []string{"a", "x", "y"} {
+		if _, _, ct := o.Get(s); !ct.Equal(past) {
+			t.Errorf("expected %s to be cleared at %v but got %v", s, past, ct)
+		}
+	}
+
+	// an output that was already cleared keeps its time
+	if _, _, ct := o.Get("b"); !ct.Equal(past.Add(-time.Hour)) {
+		t.Errorf("expected b to stay cleared at %v but got %v", past.Add(-time.Hour), ct)
+	}
+}
+
+func TestEnsureBalanceConcurrent(t *testing.T) {
+	o := New()
+	o.Initialise(1, []string{"a", "b", "c", "d"})
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	urls := []string{"a", "b", "c", "d"}
+
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		go func(g int) {
+			defer func() { done <- struct{}{} }()
+
+			for i := 0; i < 1000; i++ {
+				o.Distribute(urls[(g+i)%4], urls, t0.Add(time.Duration(i)*time.Second))
+			}
+		}(g)
+	}
+
+	go func() {
+		defer func() { done <- struct{}{} }()
+
+		// well above the total, so that most calls top it up
+		for i := 0; i < 1000; i++ {
+			o.EnsureBalance(1000)
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+
+	if h, c := o.Sums(); h+c < 1000-1e-9 {
+		t.Errorf("expected a total of at least 1000 but got %v", h+c)
+	}
+	if _, v := o.Virtual(); v == 0 {
+		t.Errorf("expected the top up to have gone to the virtual entry")
+	}
+}
+
+func TestInitialiseEmpty(t *testing.T) {
+	o := New()
+	o.Initialise(1, []string{"a", "b"})
+	o.dirty = false
+
+	expected := o.ContentHash()
+
+	o.InitialiseN(1, nil)
+	o.Initialise(1, []string{})
+
+	if o.ContentHash() != expected {
+		t.Errorf("expected the state to be unchanged")
+	}
+	if o.Dirty() {
+		t.Errorf("expected the state to still be clean")
+	}
+	if h, c := o.Sums(); math.IsNaN(h) || math.IsNaN(c) || math.IsInf(c, 0) {
+		t.Errorf("expected finite sums but got %v and %v", h, c)
+	}
+}
+
+func TestEstimateEdgeCases(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	o := New()
+	o.Initialise(1, []string{"a", "b"})
+	o.Distribute("a", []string{"b"}, t0)
+
+	h, c, _ := o.Get("a")
+
+	for _, tc := range []struct {
+		name     string
+		interval time.Duration
+		t        time.Time
+		expected float64
+	}{
+		{"zero interval", 0, t0.Add(time.Minute), c},
+		{"negative interval", -time.Hour, t0.Add(time.Minute), c},
+		{"zero elapsed", time.Hour, t0, h + c},
+		{"negative elapsed", time.Hour, t0.Add(-time.Minute), h + c},
+		{"half elapsed", time.Hour, t0.Add(time.Minute * 30), h/2 + c},
+		{"interval elapsed", time.Hour, t0.Add(time.Hour), c},
+		{"twice interval elapsed", time.Hour, t0.Add(time.Hour * 2), c / 2},
+	} {
+		e := o.Estimate("a", tc.interval, tc.t)
+		if math.IsNaN(e) || math.IsInf(e, 0) || math.Abs(e-tc.expected) > 1e-15 {
+			t.Errorf("%s: expected %v but got %v", tc.name, tc.expected, e)
+		}
+	}
+}
+
+func TestEstimateBeforeCleared(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	o := New()
+	o.Initialise(1, []string{"a", "b", "c"})
+	o.Distribute("a", []string{"b", "c"}, t0)
+	o.Distribute("b", []string{"c"}, t0.Add(time.Hour))
+
+	// events replayed out of order ask about times before the fetch, which
+	// have to estimate as if it had only just happened
+	for _, s := range []string{"a", "b"} {
+		h, c, ct := o.Get(s)
+
+		for _, d := range []time.Duration{time.Nanosecond, time.Minute, time.Hour * 24 * 365} {
+			if e := o.Estimate(s, time.Hour, ct.Add(-d)); e != h+c {
+				t.Errorf("%s, %v early: expected %v but got %v", s, d, h+c, e)
+			}
+		}
+	}
+}
+
+// benchmarkLinks returns a page's worth of outlinks, along with their hashes.
+func benchmarkLinks(o *OPIC, n int) ([]string, []uint64) {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = fmt.Sprintf("http://example.com/%d", i)
+	}
+
+	return out, o.hashList(out)
+}
+
+func BenchmarkDistribute(b *testing.B) {
+	o := New()
+	out, _ := benchmarkLinks(o, 200)
+	o.Initialise(1, out)
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		o.Distribute(out[i%len(out)], out, t0)
+	}
+}
+
+func BenchmarkDistributeN(b *testing.B) {
+	o := New()
+	out, outH := benchmarkLinks(o, 200)
+	o.Initialise(1, out)
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		o.DistributeN(outH[i%len(outH)], outH, t0)
+	}
+}
+
+// benchmarkEstimateV ranks a batch of 100k URLs the way a scheduler would.
+func benchmarkEstimateV(b *testing.B, estimate func(o *OPIC, v []string, t time.Time) []float64) {
+	o := New()
+	v, _ := benchmarkLinks(o, 100000)
+	o.Initialise(1, v)
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 1000; i++ {
+		o.Distribute(v[i], v[i+1:i+11], t0)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		estimate(o, v, t0.Add(time.Hour))
+	}
+}
+
+func BenchmarkEstimateV(b *testing.B) {
+	benchmarkEstimateV(b, func(o *OPIC, v []string, t time.Time) []float64 {
+		return o.EstimateV(v, time.Hour*24, t)
+	})
+}
+
+func BenchmarkEstimateVParallel(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkEstimateV(b, func(o *OPIC, v []string, t time.Time) []float64 {
+				return o.EstimateVParallel(v, time.Hour*24, t, workers)
+			})
+		})
+	}
+}
+
+func TestDistributeDuplicateOutputs(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	o := New()
+	o.Initialise(1, []string{"a", "b", "c"})
+	o.Distribute("a", []string{"b", "b", "c", "b"}, t0)
+
+	// each target gets one share of a third of a's cash, with the last third
+	// going to the virtual entry
+	for _, s := range []string{"b", "c"} {
+		if _, c, _ := o.Get(s); math.Abs(c-(1.0/3+1.0/9)) > 1e-15 {
+			t.Errorf("expected %s to have %v but got %v", s, 1.0/3+1.0/9, c)
+		}
+	}
+
+	if _, c := o.Sums(); math.Abs(c-1) > 1e-15 {
+		t.Errorf("expected a current total of 1 but got %v", c)
+	}
+
+	u := New()
+	u.Initialise(1, []string{"a", "b", "c"})
+	u.Distribute("a", []string{"b", "c"}, t0)
+
+	if o.ContentHash() != u.ContentHash() {
+		t.Errorf("expected the same state as distributing to each output once")
+	}
+}
+
+func TestDistributeSelfLink(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	o := New()
+	o.Initialise(1, []string{"a", "b"})
+
+	h0, c0 := o.Sums()
+	_, a0, _ := o.Get("a")
+
+	o.Distribute("a", []string{"a", "b", "a"}, t0)
+
+	// the self-links are dropped, so a's cash was only split with b and the
+	// virtual entry, and it's all moved into a's history
+	h, c := o.Sums()
+	if math.Abs(c-c0) > 1e-15 {
+		t.Errorf("expected a current total of %v but got %v", c0, c)
+	}
+	if math.Abs(h-(h0+a0)) > 1e-15 {
+		t.Errorf("expected a history total of %v but got %v", h0+a0, h)
+	}
+	if _, c, _ := o.Get("b"); math.Abs(c-(0.5+0.25)) > 1e-15 {
+		t.Errorf("expected b to have %v but got %v", 0.5+0.25, c)
+	}
+}
+
+func TestSerialisationDeterministic(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	build := func(order []int) *Serialisable {
+		s := &Serialisable{OPIC: New()}
+		s.SetTrackURLs(true)
+
+		for _, i := range order {
+			u := fmt.Sprintf("http://example.com/%d", i)
+			s.Initialise(float64(i)/7, []string{u})
+			s.FinaliseAt([]string{u}, t0.Add(time.Duration(i)*time.Second))
+			s.Initialise(float64(i)/11, []string{u})
+			s.SetInterval(u, time.Duration(i+1)*time.Minute)
+		}
+
+		return s
+	}
+
+	var order []int
+	for i := 0; i < 100; i++ {
+		order = append(order, i)
+	}
+
+	a := build(order)
+
+	var first, second bytes.Buffer
+	if _, err := a.WriteTo(&first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.WriteTo(&second); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Errorf("expected serialising the same state twice to give the same bytes")
+	}
+
+	// the same entries added in another order end up in the maps in another
+	// order, but still serialise the same way
+	rand.New(rand.NewSource(1)).Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+
+	var other bytes.Buffer
+	if _, err := build(order).WriteTo(&other); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), other.Bytes()) {
+		t.Errorf("expected the same state built in another order to give the same bytes")
+	}
+}
+
+// newPruneTestOPIC makes an instance where a has just been fetched, so has
+// little current cash but plenty of history, and two entries in the tail
+// have almost nothing at all.
+func newPruneTestOPIC(t0 time.Time) *OPIC {
+	o := New()
+	o.Initialise(1, []string{"a", "b", "c", "d"})
+	o.Distribute("a", []string{"b"}, t0)
+	o.Initialise(0.001, []string{"tail1"})
+	o.Initialise(0.002, []string{"tail2"})
+
+	return o
+}
+
+// checkPruned checks that pruning kept the sums and the entries in kept,
+// and dropped the entries in dropped.
+func checkPruned(t *testing.T, name string, before, after *OPIC, kept, dropped []string) {
+	t.Helper()
+
+	bh, bc := before.Sums()
+	ah, ac := after.Sums()
+	if math.Abs(ah-bh) > 1e-15 || math.Abs(ac-bc) > 1e-15 {
+		t.Errorf("%s: expected sums of %v/%v but got %v/%v", name, bh, bc, ah, ac)
+	}
+
+	for _, s := range kept {
+		bh, bc, bt := before.Get(s)
+		ah, ac, at := after.Get(s)
+		if ah != bh || ac != bc || !at.Equal(bt) {
+			t.Errorf("%s: expected %s to be unchanged", name, s)
+		}
+	}
+
+	for _, s := range dropped {
+		if after.Contains(s) {
+			t.Errorf("%s: expected %s to be pruned", name, s)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	o := newPruneTestOPIC(t0)
+
+	p := o.Snapshot()
+	if n := p.Prune(0.05); n != 3 {
+		t.Errorf("Prune: expected 3 entries to be removed but got %d", n)
+	}
+	checkPruned(t, "Prune", o, p, []string{"b", "c", "d"}, []string{"a", "tail1", "tail2"})
+
+	// a has history, so it's kept
+	p = o.Snapshot()
+	if n := p.PruneWithHistory(0.05); n != 2 {
+		t.Errorf("PruneWithHistory: expected 2 entries to be removed but got %d", n)
+	}
+	checkPruned(t, "PruneWithHistory", o, p, []string{"a", "b", "c", "d"}, []string{"tail1", "tail2"})
+}
+
+func TestPruneOlderThan(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	o := newPruneTestOPIC(t0)
+	o.Distribute("c", nil, t0.Add(time.Hour*2))
+
+	// a and b were fetched and linked to at t0, c later, and d and the tail
+	// have never been fetched, so they're kept whatever the cutoff
+	p := o.Snapshot()
+	if n := p.PruneOlderThan(t0.Add(time.Hour)); n != 2 {
+		t.Errorf("expected 2 entries to be removed but got %d", n)
+	}
+	checkPruned(t, "fetched", o, p, []string{"c", "d", "tail1", "tail2"}, []string{"a", "b"})
+
+	p = o.Snapshot()
+	if n := p.PruneOlderThan(t0.Add(time.Hour * 24 * 365)); n != 3 {
+		t.Errorf("expected 3 entries to be removed but got %d", n)
+	}
+	checkPruned(t, "never fetched", o, p, []string{"d", "tail1", "tail2"}, []string{"a", "b", "c"})
+}
+
+func TestFinaliseAtEstimate(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := t0.Add(time.Hour * 48)
+
+	o := New()
+	o.Initialise(1, []string{"a", "b"})
+	o.Distribute("a", []string{"b"}, t0)
+
+	_, c, _ := o.Get("b")
+
+	// finalising at the end of the window restarts the estimate from there,
+	// with the whole of the finalised cash counting straight away
+	f := o.Snapshot()
+	f.FinaliseAt([]string{"b"}, end)
+
+	if h, c2, ct := f.Get("b"); h != c || c2 != 0 || !ct.Equal(end) {
+		t.Errorf("expected b to be finalised at %v with history %v but got %v, %v, %v", end, c, h, c2, ct)
+	}
+	if e := f.Estimate("b", time.Hour*24, end); e != c {
+		t.Errorf("expected an estimate of %v straight after finalising but got %v", c, e)
+	}
+	if e := f.Estimate("b", time.Hour*24, end.Add(time.Hour*12)); math.Abs(e-c/2) > 1e-15 {
+		t.Errorf("expected an estimate of %v half an interval later but got %v", c/2, e)
+	}
+
+	// whereas Finalise leaves the old cleared time, which is more than an
+	// interval ago, so the history doesn't count at all
+	f = o.Snapshot()
+	f.Finalise([]string{"b"})
+
+	if e := f.Estimate("b", time.Hour*24, end); e != 0 {
+		t.Errorf("expected an estimate of 0 after Finalise but got %v", e)
+	}
+}
+
+func TestNormalise(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	o := New()
+	o.Initialise(1, []string{"a", "b", "c", "d"})
+	o.Distribute("a", []string{"b", "c"}, t0)
+	o.EnsureBalance(3)
+
+	before := o.Snapshot()
+	bh, _ := before.Sums()
+
+	o.Normalise(10)
+
+	h, c := o.Sums()
+	if math.Abs(c-10) > 1e-12 {
+		t.Errorf("expected a current total of 10 but got %v", c)
+	}
+	if h != bh {
+		t.Errorf("expected the history total to stay at %v but got %v", bh, h)
+	}
+
+	// every pair of entries keeps the same ratio
+	urls := []string{"a", "b", "c", "d"}
+	for i, x := range urls {
+		for _, y := range urls[i+1:] {
+			_, bx, _ := before.Get(x)
+			_, by, _ := before.Get(y)
+			_, ax, _ := o.Get(x)
+			_, ay, _ := o.Get(y)
+
+			if math.Abs(ax/ay-bx/by) > 1e-12 {
+				t.Errorf("expected %s/%s to stay at %v but got %v", x, y, bx/by, ax/ay)
+			}
+		}
+	}
+
+	_, bv := before.Virtual()
+	_, bc := before.Sums()
+	if _, v := o.Virtual(); math.Abs(v-bv*10/bc) > 1e-12 {
+		t.Errorf("expected the virtual entry to be scaled to %v but got %v", bv*10/bc, v)
+	}
+}
+
+func TestDecay(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	o := New()
+	o.Initialise(1, []string{"a", "b", "c"})
+	o.Distribute("a", []string{"b", "c"}, t0)
+	o.Distribute("b", []string{"c"}, t0)
+	o.Distribute("c", nil, t0)
+
+	// removing b leaves its history with the virtual entry
+	o.Remove("b")
+
+	urls := []string{"a", "c"}
+
+	for i := 0; i < 10; i++ {
+		before := o.Snapshot()
+		bh, bc := before.Sums()
+
+		o.Decay(0.9)
+
+		h, c := o.Sums()
+		if !(h < bh) || math.Abs(h-bh*0.9) > 1e-12 {
+			t.Errorf("round %d: expected the history total to fall to %v but got %v", i, bh*0.9, h)
+		}
+		if math.Abs(c-bc) > 1e-15 {
+			t.Errorf("round %d: expected the current total to stay at %v but got %v", i, bc, c)
+		}
+
+		for _, s := range urls {
+			bh, bc, _ := before.Get(s)
+			h, c, _ := o.Get(s)
+			if !(h < bh) || c != bc {
+				t.Errorf("round %d: expected %s's history to fall from %v with current %v, got %v and %v", i, s, bh, bc, h, c)
+			}
+		}
+	}
+
+	// without the virtual entry, its history is left alone
+	vh, _ := o.Virtual()
+	if vh == 0 {
+		t.Fatal("expected the virtual entry to have some history")
+	}
+	o.DecayHistory(0.5, false)
+	if h, _ := o.Virtual(); h != vh {
+		t.Errorf("expected the virtual history to stay at %v but got %v", vh, h)
+	}
+}
+
+func TestDistributeMulti(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	batch := []DistributeOp{
+		{Source: "a", Out: []string{"b", "c"}},
+		{Source: "b", Out: []string{"c", "d", "new"}},
+		{Source: "a", Out: []string{"d"}},
+		{Source: "c"},
+	}
+
+	m := New()
+	m.Initialise(1, []string{"a", "b", "c", "d"})
+	s := m.Snapshot()
+
+	r := m.DistributeMulti(batch, t0)
+
+	for i, op := range batch {
+		if c := s.Distribute(op.Source, op.Out, t0); r[i] != c {
+			t.Errorf("op %d: expected %v to be distributed but got %v", i, c, r[i])
+		}
+	}
+
+	if m.ContentHash() != s.ContentHash() {
+		t.Errorf("expected the same state as distributing one at a time")
+	}
+}
+
+func TestSetMinShare(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	o := New()
+	o.SetMinShare(0.1)
+	o.Initialise(1, []string{"a", "b"})
+
+	// a's half is split six ways, which is below the threshold
+	o.Distribute("a", []string{"b", "x1", "x2", "x3", "x4"}, t0)
+
+	for _, s := range []string{"x1", "x2", "x3", "x4"} {
+		if o.Contains(s) {
+			t.Errorf("expected %s not to be created", s)
+		}
+	}
+	if _, c, _ := o.Get("b"); c != 0.5 {
+		t.Errorf("expected b to keep 0.5 but got %v", c)
+	}
+	if _, c := o.Sums(); math.Abs(c-1) > 1e-15 {
+		t.Errorf("expected a current total of 1 but got %v", c)
+	}
+
+	// b's half is only split two ways, which isn't
+	o.Distribute("b", []string{"x1"}, t0)
+
+	if _, c, _ := o.Get("x1"); c != 0.25 {
+		t.Errorf("expected x1 to get 0.25 but got %v", c)
+	}
+	if _, c := o.Sums(); math.Abs(c-1) > 1e-15 {
+		t.Errorf("expected a current total of 1 but got %v", c)
+	}
+}
+
+func TestFlushVirtual(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	o := New()
+	o.Initialise(1, []string{"a", "b", "c", "d", "e"})
+	o.Distribute("a", []string{"b"}, t0)
+	o.Distribute("c", nil, t0)
+
+	before := o.Snapshot()
+	bh, bc := before.Sums()
+	_, v := before.Virtual()
+	share := v / float64(before.Len())
+
+	o.FlushVirtual()
+
+	h, c := o.Sums()
+	if h != bh || math.Abs(c-bc) > 1e-15 {
+		t.Errorf("expected sums of %v/%v but got %v/%v", bh, bc, h, c)
+	}
+
+	// everyone gets the same share, and the virtual entry is left with no
+	// more than the rounding error
+	for _, s := range []string{"a", "b", "c", "d", "e"} {
+		_, b, _ := before.Get(s)
+		if _, c, _ := o.Get(s); math.Abs(c-b-share) > 1e-15 {
+			t.Errorf("expected %s to get %v but got %v", s, share, c-b)
+		}
+	}
+	if _, v := o.Virtual(); math.Abs(v) > 1e-15 {
+		t.Errorf("expected the virtual entry to be emptied but it has %v", v)
+	}
+}
+
+func TestSetSkipDegenerate(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+
+	o := New()
+	o.Initialise(1, []string{"a", "b"})
+	o.Distribute("a", []string{"b"}, t0)
+
+	// the virtual entry has a's 0.25, less the 0.0625 paid back to a
+	if _, v := o.Virtual(); v != 0.1875 {
+		t.Fatalf("expected the virtual entry to have 0.1875 but got %v", v)
+	}
+
+	// by default, an unknown dead end is paid a share of the virtual entry
+	d := o.Snapshot()
+	if c := d.Distribute("x", nil, t1); c != 0 {
+		t.Errorf("expected nothing to be distributed but got %v", c)
+	}
+	if h, c, ct := d.Get("x"); h != 0 || c != 0.046875 || !ct.Equal(t1) {
+		t.Errorf("expected x to be paid 0.046875 at %v but got %v, %v, %v", t1, h, c, ct)
+	}
+	if _, v := d.Virtual(); v != 0.140625 {
+		t.Errorf("expected the virtual entry to have 0.140625 but got %v", v)
+	}
+
+	// with skip set, nothing happens at all
+	s := o.Snapshot()
+	s.SetSkipDegenerate(true)
+	if c := s.Distribute("x", nil, t1); c != 0 {
+		t.Errorf("expected nothing to be distributed but got %v", c)
+	}
+	if s.ContentHash() != o.ContentHash() {
+		t.Errorf("expected the state to be unchanged")
+	}
+
+	// but a source with cash or outputs isn't degenerate
+	s.Distribute("b", nil, t1)
+	s.Distribute("y", []string{"a"}, t1)
+	d = o.Snapshot()
+	d.Distribute("b", nil, t1)
+	d.Distribute("y", []string{"a"}, t1)
+	if s.ContentHash() != d.ContentHash() {
+		t.Errorf("expected other distributions to be unaffected")
+	}
+}
+
+func TestFinaliseWhereCutoff(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cutoff := t0.Add(time.Hour)
+
+	o := New()
+	o.Initialise(1, []string{"a", "b", "c", "d"})
+	o.Distribute("a", []string{"b"}, t0)
+	o.Distribute("c", []string{"d"}, t0.Add(time.Hour*2))
+
+	before := o.Snapshot()
+
+	// a and b were cleared before the cutoff, and c and d after it
+	n, total := o.FinaliseWhere(func(key uint64, current float64, cleared time.Time) bool {
+		if key == 0 {
+			t.Errorf("expected the virtual entry not to be offered")
+		}
+
+		return !cleared.IsZero() && cleared.Before(cutoff)
+	})
+
+	_, ac, _ := before.Get("a")
+	_, bc, _ := before.Get("b")
+	if n != 2 || math.Abs(total-(ac+bc)) > 1e-15 {
+		t.Errorf("expected 2 entries with %v to be finalised but got %d with %v", ac+bc, n, total)
+	}
+
+	for _, s := range []string{"a", "b"} {
+		_, bc, bt := before.Get(s)
+		if h, c, ct := o.Get(s); h != bc || c != 0 || !ct.Equal(bt) {
+			t.Errorf("expected %s to be finalised with history %v but got %v, %v, %v", s, bc, h, c, ct)
+		}
+	}
+	for _, s := range []string{"c", "d"} {
+		bh, bc, bt := before.Get(s)
+		if h, c, ct := o.Get(s); h != bh || c != bc || !ct.Equal(bt) {
+			t.Errorf("expected %s to be unchanged", s)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Package opichttp serves estimates from an OPIC instance over HTTP, so that
+// other services can query importance without embedding the library. It's a
+// separate package so that the core doesn't depend on net/http.
+package opichttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"fknsrs.biz/p/opic"
+)
+
+// DefaultInterval is the interval used when a request doesn't give one.
+const DefaultInterval = time.Hour * 24
+
+// Result is the details and estimate for a single URL.
+type Result struct {
+	URL      string     `json:"url"`
+	History  float64    `json:"history"`
+	Current  float64    `json:"current"`
+	Cleared  *time.Time `json:"cleared,omitempty"`
+	Estimate float64    `json:"estimate"`
+}
+
+// Handler returns a handler that serves GET /estimate. Each url parameter is
+// looked up, and the response is a JSON array with a Result for each, in the
+// same order. The optional interval parameter is a duration in the format
+// accepted by time.ParseDuration, defaulting to DefaultInterval, and the
+// optional time parameter is an RFC3339 time to estimate at, defaulting to
+// now. The handler only reads from o, so it can be served alongside whatever
+// else is updating it, and everything in a response comes from a single
+// consistent state.
+func Handler(o *opic.OPIC) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/estimate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+
+		urls := q["url"]
+		if len(urls) == 0 {
+			http.Error(w, "at least one url is required", http.StatusBadRequest)
+			return
+		}
+
+		interval := DefaultInterval
+		if s := q.Get("interval"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				http.Error(w, "invalid interval: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			interval = d
+		}
+
+		t := time.Now()
+		if s := q.Get("time"); s != "" {
+			pt, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				http.Error(w, "invalid time: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			t = pt
+		}
+
+		entries, estimates := o.GetEstimateV(urls, interval, t)
+
+		res := make([]Result, len(urls))
+		for i, u := range urls {
+			e := entries[i]
+
+			res[i] = Result{
+				URL:      u,
+				History:  e.History,
+				Current:  e.Current,
+				Estimate: estimates[i],
+			}
+
+			if !e.Cleared.IsZero() {
+				c := e.Cleared
+				res[i].Cleared = &c
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+
+	return mux
+}
@@ -0,0 +1,194 @@
+// Package opicpb implements the protobuf encoding of OPIC state described in
+// opic.proto. The wire format is encoded by hand, so using it doesn't pull in
+// any protobuf runtime.
+package opicpb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// State is a complete OPIC dataset, corresponding to the State message.
+type State struct {
+	Entries []Entry
+}
+
+// Entry corresponds to the Entry message. The Has fields record whether the
+// matching optional field is present.
+type Entry struct {
+	Key uint64
+
+	Current    float64
+	HasCurrent bool
+
+	History    float64
+	HasHistory bool
+
+	ClearedSeconds int64
+	ClearedNanos   int32
+	HasCleared     bool
+
+	Interval    int64
+	HasInterval bool
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendTag(b []byte, field, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wire))
+}
+
+func appendFixed64(b []byte, field int, v uint64) []byte {
+	b = appendTag(b, field, wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+func appendVarint(b []byte, field int, v uint64) []byte {
+	b = appendTag(b, field, wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func (e *Entry) appendTo(b []byte) []byte {
+	b = appendFixed64(b, 1, e.Key)
+	if e.HasCurrent {
+		b = appendFixed64(b, 2, math.Float64bits(e.Current))
+	}
+	if e.HasHistory {
+		b = appendFixed64(b, 3, math.Float64bits(e.History))
+	}
+	if e.HasCleared {
+		b = appendVarint(b, 4, uint64(e.ClearedSeconds))
+		if e.ClearedNanos != 0 {
+			b = appendVarint(b, 5, uint64(int64(e.ClearedNanos)))
+		}
+	}
+	if e.HasInterval {
+		b = appendVarint(b, 6, uint64(e.Interval))
+	}
+
+	return b
+}
+
+// Marshal encodes the state in the protobuf wire format.
+func (s *State) Marshal() ([]byte, error) {
+	var b, e []byte
+
+	for i := range s.Entries {
+		e = s.Entries[i].appendTo(e[:0])
+
+		b = appendTag(b, 1, wireBytes)
+		b = binary.AppendUvarint(b, uint64(len(e)))
+		b = append(b, e...)
+	}
+
+	return b, nil
+}
+
+// Unmarshal decodes a state from the protobuf wire format, replacing any
+// entries already present. Unknown fields are skipped.
+func (s *State) Unmarshal(b []byte) error {
+	s.Entries = nil
+
+	return eachField(b, func(field, wire int, v uint64, d []byte) error {
+		if field != 1 {
+			return nil
+		}
+		if wire != wireBytes {
+			return fmt.Errorf("opicpb: invalid wire type %d for State.entries", wire)
+		}
+
+		var e Entry
+		if err := e.unmarshal(d); err != nil {
+			return err
+		}
+
+		s.Entries = append(s.Entries, e)
+
+		return nil
+	})
+}
+
+func (e *Entry) unmarshal(b []byte) error {
+	return eachField(b, func(field, wire int, v uint64, d []byte) error {
+		want := wireFixed64
+		if field >= 4 && field <= 6 {
+			want = wireVarint
+		}
+		if field >= 1 && field <= 6 && wire != want {
+			return fmt.Errorf("opicpb: invalid wire type %d for Entry field %d", wire, field)
+		}
+
+		switch field {
+		case 1:
+			e.Key = v
+		case 2:
+			e.Current, e.HasCurrent = math.Float64frombits(v), true
+		case 3:
+			e.History, e.HasHistory = math.Float64frombits(v), true
+		case 4:
+			e.ClearedSeconds, e.HasCleared = int64(v), true
+		case 5:
+			e.ClearedNanos = int32(v)
+		case 6:
+			e.Interval, e.HasInterval = int64(v), true
+		}
+
+		return nil
+	})
+}
+
+// eachField walks the fields of an encoded message. For varint and fixed
+// width fields the value is passed as v, and for length-delimited fields the
+// contents are passed as d.
+func eachField(b []byte, fn func(field, wire int, v uint64, d []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("opicpb: invalid tag")
+		}
+		b = b[n:]
+
+		field, wire := int(tag>>3), int(tag&7)
+
+		var v uint64
+		var d []byte
+
+		switch wire {
+		case wireVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return fmt.Errorf("opicpb: invalid varint in field %d", field)
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return fmt.Errorf("opicpb: truncated field %d", field)
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return fmt.Errorf("opicpb: truncated field %d", field)
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return fmt.Errorf("opicpb: truncated field %d", field)
+			}
+			d, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return fmt.Errorf("opicpb: unsupported wire type %d in field %d", wire, field)
+		}
+
+		if err := fn(field, wire, v, d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
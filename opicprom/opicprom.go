@@ -0,0 +1,71 @@
+// Package opicprom exports metrics about an OPIC instance to Prometheus. It's
+// a separate module, with its own go.mod, so that only users who want the
+// metrics depend on the Prometheus client library.
+package opicprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"fknsrs.biz/p/opic"
+)
+
+var (
+	entriesDesc = prometheus.NewDesc(
+		"opic_entries_total",
+		"Number of entries with a current value, not counting the virtual entry.",
+		nil, nil,
+	)
+	currentDesc = prometheus.NewDesc(
+		"opic_current_cash_sum",
+		"Total current cash, including the virtual entry.",
+		nil, nil,
+	)
+	historyDesc = prometheus.NewDesc(
+		"opic_history_cash_sum",
+		"Total history cash, including the virtual entry.",
+		nil, nil,
+	)
+	virtualDesc = prometheus.NewDesc(
+		"opic_virtual_current",
+		"Current cash held by the virtual entry.",
+		nil, nil,
+	)
+	driftDesc = prometheus.NewDesc(
+		"opic_drift",
+		"Total history cash minus total current cash.",
+		nil, nil,
+	)
+)
+
+// Collector is a prometheus.Collector that reads its metrics from an OPIC
+// instance each time it's collected. All of them come from a single call to
+// Stats, so they're consistent with each other.
+type Collector struct {
+	o *opic.OPIC
+}
+
+// NewCollector creates a Collector for o. Register it with a
+// prometheus.Registerer to export the metrics.
+func NewCollector(o *opic.OPIC) *Collector {
+	return &Collector{o: o}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- entriesDesc
+	ch <- currentDesc
+	ch <- historyDesc
+	ch <- virtualDesc
+	ch <- driftDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.o.Stats()
+
+	ch <- prometheus.MustNewConstMetric(entriesDesc, prometheus.GaugeValue, float64(s.Entries))
+	ch <- prometheus.MustNewConstMetric(currentDesc, prometheus.GaugeValue, s.Current)
+	ch <- prometheus.MustNewConstMetric(historyDesc, prometheus.GaugeValue, s.History)
+	ch <- prometheus.MustNewConstMetric(virtualDesc, prometheus.GaugeValue, s.VirtualCurrent)
+	ch <- prometheus.MustNewConstMetric(driftDesc, prometheus.GaugeValue, s.History-s.Current)
+}
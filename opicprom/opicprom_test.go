@@ -0,0 +1,38 @@
+package opicprom
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"fknsrs.biz/p/opic"
+)
+
+func TestCollector(t *testing.T) {
+	o := opic.New()
+	o.Initialise(1, []string{"a", "b"})
+	o.Finalise([]string{"a"})
+
+	expected := `
+# HELP opic_current_cash_sum Total current cash, including the virtual entry.
+# TYPE opic_current_cash_sum gauge
+opic_current_cash_sum 0.5
+# HELP opic_drift Total history cash minus total current cash.
+# TYPE opic_drift gauge
+opic_drift 0
+# HELP opic_entries_total Number of entries with a current value, not counting the virtual entry.
+# TYPE opic_entries_total gauge
+opic_entries_total 2
+# HELP opic_history_cash_sum Total history cash, including the virtual entry.
+# TYPE opic_history_cash_sum gauge
+opic_history_cash_sum 0.5
+# HELP opic_virtual_current Current cash held by the virtual entry.
+# TYPE opic_virtual_current gauge
+opic_virtual_current 0
+`
+
+	if err := testutil.CollectAndCompare(NewCollector(o), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,12 +1,58 @@
 package opic
 
 import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 )
 
+// PersistentLoadOptions controls how Load reads the file. A nil
+// *PersistentLoadOptions is the same as the zero value.
 type PersistentLoadOptions struct {
+	// IgnoreMissing makes Load succeed without doing anything if the file
+	// doesn't exist yet, for bootstrapping on first run.
 	IgnoreMissing bool
+	// SkipCorrupt salvages what it can from a damaged file. See
+	// ReadOptions.SkipCorrupt for what can and can't be recovered.
+	SkipCorrupt bool
+	// Reconcile fills in any entries missing from one of the internal maps
+	// once the file has been read. See OPIC.Reconcile.
+	Reconcile bool
+	// Lock takes a shared advisory lock while reading, so that the file
+	// can't be replaced by a Save using SaveOptions.Lock part way through.
+	// See PersistentSaveOptions.Lock for caveats.
+	Lock bool
+	// Exclusive claims the file for this instance until Close is called, so
+	// that two processes can't both load and save it and have one silently
+	// overwrite the other. Load fails if another process has already claimed
+	// it. The claim is an advisory lock on a sidecar file with a ".owner"
+	// suffix, with the same caveats as PersistentSaveOptions.Lock, and only
+	// keeps out other instances that use Exclusive too.
+	Exclusive bool
+}
+
+// PersistentSaveOptions controls how Save writes the file.
+type PersistentSaveOptions struct {
+	// TempDir is where the temporary file is written before being renamed
+	// over the target. It defaults to the directory containing the target,
+	// and must be on the same filesystem so that the rename is atomic. Either
+	// way, the directory has to be writable.
+	TempDir string
+	// TempPrefix is the name prefix of the temporary file. It defaults to
+	// "opic".
+	TempPrefix string
+	// Lock takes an exclusive advisory lock while renaming the new file into
+	// place, coordinating with readers using PersistentLoadOptions.Lock. The
+	// rename is already atomic on local filesystems, but the lock makes the
+	// exclusion explicit for backends where it isn't. The lock is held on a
+	// sidecar file with a ".lock" suffix, is purely advisory, uses flock so
+	// may not work across NFS, and does nothing on platforms without flock.
+	Lock bool
 }
 
 // Persistent extends OPIC with a disk-based persistency mechanism.
@@ -14,49 +60,298 @@ type Persistent struct {
 	*Serialisable
 
 	filename string
+	compress bool
+
+	// saveM stops Saves from overlapping
+	saveM sync.Mutex
+
+	autosaveM   sync.Mutex
+	autosaveErr error
+
+	// release gives up the claim taken by PersistentLoadOptions.Exclusive
+	release func() error
+
+	walFile string
+	walM    sync.Mutex
+	wal     *os.File
+	walErr  error
 }
 
 // NewPersistent creates a new Persistent OPIC instance backed by a particular
-// file.
+// file, using 64 bit FNV-1 to hash URLs.
 func NewPersistent(filename string) *Persistent {
+	return NewPersistentWithHash(filename, fnvHash)
+}
+
+// NewPersistentWithHash is like NewPersistent, but uses h to hash URLs. The
+// file only holds hashes, so it must always be loaded with the same function
+// it was saved with. See NewWithHash.
+func NewPersistentWithHash(filename string, h HashFunc) *Persistent {
 	return &Persistent{
-		Serialisable: &Serialisable{OPIC: New()},
+		Serialisable: &Serialisable{OPIC: NewWithHash(h)},
 		filename:     filename,
 	}
 }
 
+// NewPersistentCompressed is like NewPersistent, but the file is gzipped when
+// it's saved. Load detects gzipped files by their contents whichever way the
+// instance was created, so switching between the two doesn't need the
+// existing file to be converted first.
+func NewPersistentCompressed(filename string) *Persistent {
+	return NewPersistentCompressedWithHash(filename, fnvHash)
+}
+
+// NewPersistentCompressedWithHash is like NewPersistentCompressed, but uses h
+// to hash URLs. See NewPersistentWithHash.
+func NewPersistentCompressedWithHash(filename string, h HashFunc) *Persistent {
+	p := NewPersistentWithHash(filename, h)
+	p.compress = true
+
+	return p
+}
+
 // Load does what it sounds like. It loads the OPIC state from the file
-// associated with this instance.
+// associated with this instance, and then replays the write-ahead log if it
+// was created with NewPersistentWAL. If the file can't be read in full, the
+// state is left as it was.
 func (p *Persistent) Load(o *PersistentLoadOptions) error {
+	_, err := p.LoadWithReport(o)
+	return err
+}
+
+// LoadWithReport is like Load, but also returns a report describing anything
+// unusual encountered while reading the file, and how many entries it held,
+// e.g. for checking against a manifest written alongside it. The counts don't
+// include anything replayed from a write-ahead log.
+func (p *Persistent) LoadWithReport(o *PersistentLoadOptions) (ReadReport, error) {
+	if o != nil && o.Exclusive && p.release == nil {
+		release, err := ownFile(p.filename)
+		if err != nil {
+			return ReadReport{}, err
+		}
+
+		p.release = release
+	}
+
+	if o != nil && o.Lock {
+		unlock, err := lockFile(p.filename, false)
+		if err != nil {
+			return ReadReport{}, err
+		}
+		defer unlock()
+	}
+
+	// nothing done while loading needs logging, since it's all either in
+	// the file or already in the log
+	p.m.Lock()
+	onDistribute, onUnlogged := p.onDistribute, p.onUnlogged
+	p.onDistribute, p.onUnlogged = nil, nil
+	p.m.Unlock()
+
+	defer func() {
+		p.m.Lock()
+		p.onDistribute, p.onUnlogged = onDistribute, onUnlogged
+		p.m.Unlock()
+	}()
+
+	report, err := p.loadSnapshot(o)
+	if err != nil {
+		return report, err
+	}
+
+	// anything fixed up by Reconcile isn't on disk yet
+	dirty := report.Reconciled.Total() > 0
+
+	if p.walFile != "" {
+		n, err := p.replayWAL()
+		if err != nil {
+			return report, fmt.Errorf("replaying %s: %w", p.walFile, err)
+		}
+
+		// and neither is anything replayed from the log, except in the log
+		if n > 0 {
+			dirty = true
+		}
+	}
+
+	p.m.Lock()
+	p.dirty = dirty
+	p.m.Unlock()
+
+	return report, nil
+}
+
+// Close gives up the claim on the file taken by Load with
+// PersistentLoadOptions.Exclusive, and closes the write-ahead log if there is
+// one. It doesn't save anything. The instance can still be used in memory
+// afterwards, and the log is reopened by the next distribution.
+func (p *Persistent) Close() error {
+	var err error
+
+	p.walM.Lock()
+	if p.wal != nil {
+		err = p.wal.Close()
+		p.wal = nil
+	}
+	p.walM.Unlock()
+
+	if p.release != nil {
+		if rerr := p.release(); err == nil {
+			err = rerr
+		}
+		p.release = nil
+	}
+
+	return err
+}
+
+// loadSnapshot reads the state file into the instance.
+func (p *Persistent) loadSnapshot(o *PersistentLoadOptions) (ReadReport, error) {
 	f, err := os.OpenFile(p.filename, os.O_RDONLY, 0644)
 	if err != nil {
 		if os.IsNotExist(err) && (o != nil && o.IgnoreMissing) {
-			return nil
+			return ReadReport{}, nil
 		}
 
-		return err
+		return ReadReport{}, err
 	}
 	defer f.Close()
 
-	if _, err = p.ReadFrom(f); err != nil {
-		return err
+	var ro ReadOptions
+	if o != nil {
+		ro.SkipCorrupt = o.SkipCorrupt
+		ro.Reconcile = o.Reconcile
 	}
 
-	p.dirty = false
+	br := bufio.NewReader(f)
+
+	var r io.Reader = br
+	if isGzipped(br) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return ReadReport{}, fmt.Errorf("loading %s: %w", p.filename, err)
+		}
+		defer zr.Close()
+
+		r = zr
+	}
 
-	return nil
+	_, report, err := p.ReadFromWithOptions(r, &ro)
+	if err != nil {
+		return report, fmt.Errorf("loading %s: %w", p.filename, err)
+	}
+
+	return report, nil
 }
 
 // Save does what it sounds like. It saves the OPIC state to the file
-// associated with this instance.
-func (p *Persistent) Save() error {
-	o, err := ioutil.TempFile("", "opic")
+// associated with this instance, gzipped if it was created with
+// NewPersistentCompressed.
+//
+// The state is written to a temporary file, which is synced to disk and then
+// renamed over the target, and the directory is synced after that. Once Save
+// returns successfully the new state is durable, and if it fails or the
+// machine crashes part way through, the file holds either the old state or
+// the new one, never a mix of the two. The temporary file goes in the same
+// directory as the target unless PersistentSaveOptions.TempDir says
+// otherwise, so that directory must be writable, not just the file. If it
+// was created with NewPersistentWAL, the write-ahead log is emptied once the
+// new state is in place. Saves are serialised, so it's safe to call from more
+// than one goroutine, e.g. alongside StartAutosave.
+func (p *Persistent) Save(so *PersistentSaveOptions) error {
+	p.saveM.Lock()
+	defer p.saveM.Unlock()
+
+	// dirty is cleared before the state is written rather than after, so that
+	// a change made while it's being written isn't forgotten
+	p.m.Lock()
+	dirty := p.dirty
+	p.dirty = false
+	p.m.Unlock()
+
+	err := p.saveAndTruncate(so)
+	if err != nil && dirty {
+		p.m.Lock()
+		p.dirty = true
+		p.m.Unlock()
+	}
+
+	return err
+}
+
+// saveAndTruncate does the work of Save.
+func (p *Persistent) saveAndTruncate(so *PersistentSaveOptions) error {
+	if p.walFile == "" {
+		return p.save(so, p.WriteToStream)
+	}
+
+	// the log can only be emptied if nothing has been distributed since the
+	// state was written, so the read lock is held until it has been
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	if err := p.save(so, p.writeToStream); err != nil {
+		return err
+	}
+
+	return p.truncateWAL()
+}
+
+// save writes the state with write, which is responsible for any locking,
+// and then renames it into place.
+func (p *Persistent) save(so *PersistentSaveOptions, write func(w io.Writer) (int64, error)) error {
+	dir, prefix := filepath.Dir(p.filename), "opic"
+	if so != nil && so.TempDir != "" {
+		dir = so.TempDir
+	}
+	if so != nil && so.TempPrefix != "" {
+		prefix = so.TempPrefix
+	}
+
+	if dir != filepath.Dir(p.filename) {
+		same, err := sameFilesystem(dir, filepath.Dir(p.filename))
+		if err != nil {
+			return err
+		}
+		if !same {
+			return fmt.Errorf("temp dir %s is not on the same filesystem as %s", dir, p.filename)
+		}
+	}
+
+	o, err := ioutil.TempFile(dir, prefix)
 	if err != nil {
 		return err
 	}
+
+	// a failed save mustn't leave the temporary file behind, or every retry
+	// leaks another one into the directory
+	var renamed bool
+	defer func() {
+		if !renamed {
+			os.Remove(o.Name())
+		}
+	}()
 	defer o.Close()
 
-	if _, err := p.WriteTo(o); err != nil {
+	if p.compress {
+		zw := gzip.NewWriter(o)
+
+		if _, err := write(zw); err != nil {
+			return err
+		}
+
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	} else {
+		if _, err := write(o); err != nil {
+			return err
+		}
+	}
+
+	// the data has to be on disk before the rename, or a crash just after it
+	// can leave the target empty or truncated
+	if err := o.Sync(); err != nil {
 		return err
 	}
 
@@ -64,11 +359,19 @@ func (p *Persistent) Save() error {
 		return err
 	}
 
+	if so != nil && so.Lock {
+		unlock, err := lockFile(p.filename, true)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
 	if err := os.Rename(o.Name(), p.filename); err != nil {
 		return err
 	}
+	renamed = true
 
-	p.dirty = false
-
-	return nil
+	// and the directory has to be on disk for the rename itself to stick
+	return syncDir(filepath.Dir(p.filename))
 }
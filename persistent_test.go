@@ -0,0 +1,81 @@
+package opic
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveFailureRemovesTempFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a file can't be renamed over a directory that isn't empty
+	filename := filepath.Join(dir, "state.opic")
+	if err := os.MkdirAll(filepath.Join(filename, "occupied"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPersistent(filename)
+	p.Initialise(1, []string{"a", "b"})
+
+	if err := p.Save(nil); err == nil {
+		t.Fatal("expected the save to fail")
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if fi.Name() != "state.opic" {
+			t.Errorf("temporary file %s was left behind", fi.Name())
+		}
+	}
+
+	if !p.Dirty() {
+		t.Errorf("expected the state to still be dirty after a failed save")
+	}
+}
+
+func TestSaveInDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sub := filepath.Join(dir, "nested", "state")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(sub, "state.opic")
+
+	p := NewPersistent(filename)
+	p.Initialise(1, []string{"a", "b"})
+
+	if err := p.Save(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the temporary file was made alongside the target and renamed over it
+	fis, err := ioutil.ReadDir(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Name() != "state.opic" {
+		t.Errorf("expected only the state file in %s", sub)
+	}
+
+	q := NewPersistent(filename)
+	if err := q.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+	if q.ContentHash() != p.ContentHash() {
+		t.Errorf("loaded state doesn't match the saved state")
+	}
+}
@@ -0,0 +1,85 @@
+package opic
+
+import (
+	"sort"
+	"time"
+
+	"fknsrs.biz/p/opic/opicpb"
+)
+
+// MarshalProto encodes the dataset as an opicpb.State protobuf message, for
+// systems that would rather speak protobuf than the binary format. Entries
+// are emitted in key order.
+func (s *Serialisable) MarshalProto() ([]byte, error) {
+	s.m.RLock()
+
+	seen := make(map[uint64]struct{}, len(s.current))
+	for k := range s.current {
+		seen[k] = struct{}{}
+	}
+	for k := range s.history {
+		seen[k] = struct{}{}
+	}
+	for k := range s.cleared {
+		seen[k] = struct{}{}
+	}
+	for k := range s.intervals {
+		seen[k] = struct{}{}
+	}
+
+	st := opicpb.State{Entries: make([]opicpb.Entry, 0, len(seen))}
+	for k := range seen {
+		e := opicpb.Entry{Key: k}
+		e.Current, e.HasCurrent = s.current[k]
+		e.History, e.HasHistory = s.history[k]
+		if t, ok := s.cleared[k]; ok {
+			e.ClearedSeconds, e.ClearedNanos, e.HasCleared = t.Unix(), int32(t.Nanosecond()), true
+		}
+		if d, ok := s.intervals[k]; ok {
+			e.Interval, e.HasInterval = int64(d), true
+		}
+
+		st.Entries = append(st.Entries, e)
+	}
+
+	s.m.RUnlock()
+
+	sort.Slice(st.Entries, func(i, j int) bool {
+		return st.Entries[i].Key < st.Entries[j].Key
+	})
+
+	return st.Marshal()
+}
+
+// UnmarshalProto decodes a dataset encoded by MarshalProto.
+func (s *Serialisable) UnmarshalProto(d []byte) error {
+	var st opicpb.State
+	if err := st.Unmarshal(d); err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.unlogged()
+
+	for _, e := range st.Entries {
+		if e.HasCurrent {
+			s.current[e.Key] = e.Current
+		}
+		if e.HasHistory {
+			s.history[e.Key] = e.History
+		}
+		if e.HasCleared {
+			s.cleared[e.Key] = time.Unix(e.ClearedSeconds, int64(e.ClearedNanos))
+		}
+		if e.HasInterval && e.Interval > 0 {
+			if s.intervals == nil {
+				s.intervals = make(map[uint64]time.Duration)
+			}
+			s.intervals[e.Key] = time.Duration(e.Interval)
+		}
+	}
+
+	return nil
+}
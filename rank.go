@@ -0,0 +1,304 @@
+package opic
+
+import (
+	"container/heap"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// SeedFromRankings sets the current cash of o from the relative priorities
+// of other, rather than copying its absolute cash. Every entry in other is
+// estimated as of t, and the estimates are scaled so that they add up to
+// total exactly. Entries in o that aren't known to other are left alone, as
+// are cleared times, which aren't transferred. If other has no entries, or
+// all of its estimates are zero, o is left untouched.
+func (o *OPIC) SeedFromRankings(other *OPIC, total float64, interval time.Duration, t time.Time) {
+	other.m.RLock()
+	keys := make([]uint64, 0, len(other.current))
+	for k := range other.current {
+		if k != 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	scores := make([]float64, len(keys))
+	var sum float64
+	for i, k := range keys {
+		scores[i] = other.estimate(k, interval, t)
+		sum += scores[i]
+	}
+	other.m.RUnlock()
+
+	if sum <= 0 {
+		return
+	}
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	// the last key absorbs any rounding error, so the total is exact
+	var given float64
+	for i, k := range keys {
+		v := total - given
+		if i < len(keys)-1 {
+			v = scores[i] / sum * total
+		}
+
+		o.current[k] = v
+		given += v
+	}
+
+	o.changed()
+}
+
+// rankedBefore defines the order that entries are ranked in everywhere in
+// this package: highest score first, with ties broken by lowest key.
+func rankedBefore(sa float64, ka uint64, sb float64, kb uint64) bool {
+	if sa != sb {
+		return sa > sb
+	}
+
+	return ka < kb
+}
+
+// ExpectedCrawlPosition returns the zero-based position url would have in
+// the frontier if every entry were fetched in order of estimate as of t.
+// Combined with a known crawl rate, this gives a rough idea of when url will
+// be fetched. The virtual entry and expired entries don't count towards the
+// position. This is a full scan, so it's O(n) in the number of entries.
+func (o *OPIC) ExpectedCrawlPosition(url string, interval time.Duration, t time.Time) int {
+	v := o.hash(url)
+
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	e := o.estimate(v, interval, t)
+
+	var n int
+	for k := range o.current {
+		if k == 0 || k == v || o.expired(k, t) {
+			continue
+		}
+
+		if rankedBefore(o.estimate(k, interval, t), k, e, v) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Ranked is an entry's key along with the score it was ranked by.
+type Ranked struct {
+	Hash  uint64
+	Score float64
+}
+
+// rank scores every entry except the virtual one and any that have expired
+// as of t, and sorts them with rankedBefore. It must be called with at least
+// the read lock held.
+func (o *OPIC) rank(t time.Time, score func(k uint64) float64) []Ranked {
+	r := make([]Ranked, 0, len(o.current))
+	for k := range o.current {
+		if k != 0 && !o.expired(k, t) {
+			r = append(r, Ranked{Hash: k, Score: score(k)})
+		}
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		return rankedBefore(r[i].Score, r[i].Hash, r[j].Score, r[j].Hash)
+	})
+
+	return r
+}
+
+// RankStaleness ranks every entry by its estimate as of t, boosted by how
+// overdue it is for a recrawl, so that important stale pages jump the queue.
+// The score is
+//
+//	estimate * (1 + stalenessWeight * overdue)
+//
+// where overdue is how many intervals past its first interval the entry was
+// last cleared, i.e. max(0, (t - cleared) / interval - 1). Entries that have
+// never been cleared aren't considered overdue. A stalenessWeight of zero
+// gives a ranking by estimate alone.
+func (o *OPIC) RankStaleness(interval time.Duration, t time.Time, stalenessWeight float64) []Ranked {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	return o.rank(t, func(k uint64) float64 {
+		e := o.estimate(k, interval, t)
+
+		var overdue float64
+		if vt, ok := o.cleared[k]; ok && !vt.IsZero() && interval > 0 {
+			if f := float64(t.Sub(vt))/float64(interval) - 1; f > 0 {
+				overdue = f
+			}
+		}
+
+		return e * (1 + stalenessWeight*overdue)
+	})
+}
+
+// TopNPerDomain returns the keys of up to n entries with the highest
+// estimates as of t, taking no more than perDomainMax from any one domain, to
+// produce a crawl batch that respects politeness limits. domainFn maps a key
+// to its domain; keys for which it returns false are skipped. The result is
+// in ranking order (highest estimate first, ties broken by lowest key), and
+// is the greedy selection down that order, so a key is only passed over
+// because its domain was already full. domainFn is called without any lock
+// held, so it's free to call back into the OPIC instance, e.g. to look up a
+// key's URL.
+func (o *OPIC) TopNPerDomain(n, perDomainMax int, domainFn func(uint64) (string, bool), interval time.Duration, t time.Time) []uint64 {
+	o.m.RLock()
+	ranked := o.rank(t, func(k uint64) float64 {
+		return o.estimate(k, interval, t)
+	})
+	o.m.RUnlock()
+
+	var r []uint64
+	counts := make(map[string]int)
+	for _, e := range ranked {
+		if len(r) >= n {
+			break
+		}
+
+		d, ok := domainFn(e.Hash)
+		if !ok || counts[d] >= perDomainMax {
+			continue
+		}
+
+		counts[d]++
+		r = append(r, e.Hash)
+	}
+
+	return r
+}
+
+// ToSparseVector returns the estimates of every entry as of t as a sparse
+// vector, normalised to add up to 1, for feeding into ML tooling. The keys
+// are in ascending order, and values[i] belongs to keys[i]. The virtual
+// entry, and any entry estimating as zero, is left out. If the estimates add
+// up to zero the result is empty.
+func (o *OPIC) ToSparseVector(interval time.Duration, t time.Time) ([]uint64, []float64) {
+	o.m.RLock()
+	var r []Ranked
+	var sum float64
+	for k := range o.current {
+		if k == 0 {
+			continue
+		}
+
+		if e := o.estimate(k, interval, t); e > 0 {
+			r = append(r, Ranked{Hash: k, Score: e})
+			sum += e
+		}
+	}
+	o.m.RUnlock()
+
+	if sum == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(r, func(i, j int) bool { return r[i].Hash < r[j].Hash })
+
+	keys := make([]uint64, len(r))
+	values := make([]float64, len(r))
+	for i, e := range r {
+		keys[i], values[i] = e.Hash, e.Score/sum
+	}
+
+	return keys, values
+}
+
+// entryHeap keeps the worst of the best entries so far at its root.
+type entryHeap struct {
+	e      []Entry
+	better func(a, b Entry) bool
+}
+
+func (h *entryHeap) Len() int           { return len(h.e) }
+func (h *entryHeap) Less(i, j int) bool { return h.better(h.e[j], h.e[i]) }
+func (h *entryHeap) Swap(i, j int)      { h.e[i], h.e[j] = h.e[j], h.e[i] }
+func (h *entryHeap) Push(x interface{}) { h.e = append(h.e, x.(Entry)) }
+func (h *entryHeap) Pop() interface{}   { x := h.e[len(h.e)-1]; h.e = h.e[:len(h.e)-1]; return x }
+
+// TopN returns the n entries with the most current cash, most first, with
+// ties broken by lowest key. The virtual entry and entries expired as of the
+// instance's clock (see SetClock) are left out. It uses a bounded heap, so
+// it's O(m log n) for m entries.
+func (o *OPIC) TopN(n int) []Entry {
+	return o.TopNFunc(n, func(a, b Entry) bool {
+		return rankedBefore(a.Current, a.Hash, b.Current, b.Hash)
+	})
+}
+
+// TopNFunc is like TopN, but ranks entries using better, which reports
+// whether a should come before b. better is called with the read lock held,
+// so it must not call back into the OPIC instance; to rank by estimate,
+// compute it from the entry's fields, or use RankStaleness.
+func (o *OPIC) TopNFunc(n int, better func(a, b Entry) bool) []Entry {
+	if n <= 0 {
+		return nil
+	}
+
+	h := &entryHeap{better: better}
+
+	o.m.RLock()
+	now := o.clock.Now()
+	for k := range o.current {
+		if k == 0 || o.expired(k, now) {
+			continue
+		}
+
+		e := o.entry(k)
+
+		if h.Len() < n {
+			heap.Push(h, e)
+		} else if better(e, h.e[0]) {
+			h.e[0] = e
+			heap.Fix(h, 0)
+		}
+	}
+	o.m.RUnlock()
+
+	r := make([]Entry, h.Len())
+	for i := len(r) - 1; i >= 0; i-- {
+		r[i] = heap.Pop(h).(Entry)
+	}
+
+	return r
+}
+
+// WeightedSample picks a single entry at random, with probability
+// proportional to its current cash, using rng. The virtual entry, expired
+// entries and entries without any cash are never picked, and if there's
+// nothing left to pick from it returns false. It takes a single pass under
+// the read lock, keeping a running pick as it goes, so nothing is allocated.
+func (o *OPIC) WeightedSample(rng *rand.Rand) (uint64, bool) {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	now := o.clock.Now()
+
+	var pick uint64
+	var total float64
+	var ok bool
+
+	for k, c := range o.current {
+		if k == 0 || !(c > 0) || o.expired(k, now) {
+			continue
+		}
+
+		// each entry replaces the pick with probability c/total, which leaves
+		// every entry seen so far picked with probability proportional to c
+		total += c
+		if rng.Float64()*total < c {
+			pick, ok = k, true
+		}
+	}
+
+	return pick, ok
+}
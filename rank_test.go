@@ -0,0 +1,41 @@
+package opic
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestWeightedSampleFrequencies(t *testing.T) {
+	o := New()
+
+	weights := map[string]float64{"a": 0.1, "b": 0.2, "c": 0.3, "d": 0.4}
+	for s, w := range weights {
+		o.Initialise(w, []string{s})
+	}
+	o.Initialise(0, []string{"empty"})
+
+	rng := rand.New(rand.NewSource(1))
+
+	const draws = 100000
+
+	counts := make(map[uint64]int)
+	for i := 0; i < draws; i++ {
+		k, ok := o.WeightedSample(rng)
+		if !ok {
+			t.Fatal("expected an entry to be picked")
+		}
+		counts[k]++
+	}
+
+	// each frequency has a standard deviation of at most 0.0016 over this
+	// many draws, so this allows for about six of them
+	for s, w := range weights {
+		if f := float64(counts[o.hash(s)]) / draws; math.Abs(f-w) > 0.01 {
+			t.Errorf("expected %s to be picked with frequency %v but got %v", s, w, f)
+		}
+	}
+	if n := counts[o.hash("empty")]; n != 0 {
+		t.Errorf("expected the entry without cash never to be picked, but it was picked %d times", n)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package opic
+
+// sameFilesystem can't be determined cheaply on this platform, so it's
+// assumed, and a cross-device rename will fail in Save instead.
+func sameFilesystem(a, b string) (bool, error) {
+	return true, nil
+}
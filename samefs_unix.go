@@ -0,0 +1,23 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package opic
+
+import (
+	"syscall"
+)
+
+// sameFilesystem reports whether two paths live on the same device, and so
+// whether a rename between them can be atomic.
+func sameFilesystem(a, b string) (bool, error) {
+	var sa, sb syscall.Stat_t
+
+	if err := syscall.Stat(a, &sa); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(b, &sb); err != nil {
+		return false, err
+	}
+
+	return sa.Dev == sb.Dev, nil
+}
@@ -1,180 +1,532 @@
 package opic
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"math"
+	"sort"
 	"time"
 )
 
 var (
-	expectedMagic = "#opicdb#"
+	expectedMagic   = "#opicdb#"
+	expectedVersion = uint64(5)
 )
 
+// Older versions of the format can still be read. Version 4 is the same as
+// version 5, but without the section of URLs. Version 3 is the same as
+// version 4, but with cleared times in whole seconds rather than nanoseconds.
+// Version 2 is the same as version 3, but without the section of per-entry
+// intervals, and version 1 is the same as version 2, but without the CRC32
+// trailer.
+const (
+	versionNoChecksum  = uint64(1)
+	versionNoIntervals = uint64(2)
+	versionSeconds     = uint64(3)
+	versionNoURLs      = uint64(4)
+)
+
+// supportedVersion reports whether version v of the format can be read.
+func supportedVersion(v uint64) bool {
+	return v >= versionNoChecksum && v <= expectedVersion
+}
+
+// zeroUnixNano stands in for the zero time.Time wherever times are stored as
+// Unix nanoseconds, since the zero time is outside the range they can
+// represent.
+const zeroUnixNano = math.MinInt64
+
+func toUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return zeroUnixNano
+	}
+
+	return t.UnixNano()
+}
+
+func fromUnixNano(v int64) time.Time {
+	if v == zeroUnixNano {
+		return time.Time{}
+	}
+
+	return time.Unix(0, v)
+}
+
 // Serialisable extends OPIC with methods to serialise and deserialise a
 // binary format representing the dataset.
 type Serialisable struct {
 	*OPIC
 }
 
-// ReadFrom implements io.ReaderFrom
+// ReadOptions controls how ReadFromWithOptions treats its input.
+type ReadOptions struct {
+	// SkipCorrupt makes the reader drop entries whose cash values are not
+	// finite non-negative numbers, rather than loading them. Each entry in a
+	// section has a fixed width, so the reader can carry on with the next one.
+	// A corrupt count header or a truncated file still can't be recovered
+	// from, since the format has no other framing to resynchronise on. It
+	// also turns a checksum mismatch into ReadReport.ChecksumMismatch rather
+	// than an error, for salvaging what can be salvaged from a damaged file.
+	SkipCorrupt bool
+	// Reconcile runs Reconcile over the state once it's been read.
+	Reconcile bool
+}
+
+// ReadReport describes what happened during ReadFromWithOptions.
+type ReadReport struct {
+	// Skipped is the number of entries dropped because of SkipCorrupt.
+	Skipped int
+	// SkippedOffsets holds the byte offset of each skipped entry.
+	SkippedOffsets []int64
+	// ChecksumMismatch is set if the input failed its checksum and was read
+	// anyway because of SkipCorrupt.
+	ChecksumMismatch bool
+	// Reconciled describes what Reconcile fixed, if it was requested.
+	Reconciled ReconcileReport
+	// CurrentCount, HistoryCount, ClearedCount, IntervalCount and URLCount
+	// are the number of entries read from each section of the input, not
+	// counting any skipped because of SkipCorrupt. They're what was in the
+	// input, so they can be checked against what was written, while Len
+	// afterwards also counts entries that were already there. URLs are
+	// counted even if they were discarded because URL tracking is off.
+	CurrentCount, HistoryCount, ClearedCount, IntervalCount, URLCount int
+}
+
+func validCash(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0) && v >= 0
+}
+
+// ReadFrom implements io.ReaderFrom. The entries read are added to the
+// existing state, replacing any with the same keys. The input is read in full
+// before anything is changed, so if it fails part way through, the state is
+// left as it was. URLs in the input are only kept if URL tracking is on (see
+// SetTrackURLs), so it has to be turned on before reading.
 func (s *Serialisable) ReadFrom(r io.Reader) (int64, error) {
-	s.m.Lock()
-	defer s.m.Unlock()
+	n, _, err := s.ReadFromWithOptions(r, nil)
+	return n, err
+}
+
+// ReadFromWithOptions is like ReadFrom, but allows some control over how the
+// input is handled, and reports on anything unusual it encountered.
+func (s *Serialisable) ReadFromWithOptions(r io.Reader, o *ReadOptions) (int64, ReadReport, error) {
+	var report ReadReport
+
+	skip := func(v float64, offset int64) bool {
+		if o == nil || !o.SkipCorrupt || validCash(v) {
+			return false
+		}
+
+		report.Skipped++
+		report.SkippedOffsets = append(report.SkippedOffsets, offset)
+
+		return true
+	}
+
+	h := crc32.NewIEEE()
+	cr := io.TeeReader(r, h)
 
 	n := int64(0)
 
 	var magic [8]byte
-	if err := binary.Read(r, binary.BigEndian, &magic); err != nil {
-		return n, err
+	if err := binary.Read(cr, binary.BigEndian, &magic); err != nil {
+		return n, report, fmt.Errorf("reading magic: %w", err)
 	}
 	n += 8
 
 	if string(magic[:]) != expectedMagic {
-		return n, fmt.Errorf("invalid magic")
+		return n, report, fmt.Errorf("invalid magic")
 	}
 
 	var v uint64
-	if err := binary.Read(r, binary.BigEndian, &v); err != nil {
-		return n, err
+	if err := binary.Read(cr, binary.BigEndian, &v); err != nil {
+		return n, report, fmt.Errorf("reading version: %w", err)
 	}
 	n += 8
 
-	if v != 1 {
-		return n, fmt.Errorf("invalid version; expected 0 but got %d", v)
+	if !supportedVersion(v) {
+		return n, report, fmt.Errorf("unsupported version; expected %d to %d but got %d", versionNoChecksum, expectedVersion, v)
 	}
 
 	var c uint64
 
-	if err := binary.Read(r, binary.BigEndian, &c); err != nil {
-		return n, err
+	if err := binary.Read(cr, binary.BigEndian, &c); err != nil {
+		return n, report, fmt.Errorf("reading current count: %w", err)
 	}
 	n += 8
 
+	current := make(map[uint64]float64)
+
 	for i := uint64(0); i < c; i++ {
 		var e struct {
 			K uint64
 			V float64
 		}
 
-		if err := binary.Read(r, binary.BigEndian, &e); err != nil {
-			return n, err
+		if err := binary.Read(cr, binary.BigEndian, &e); err != nil {
+			return n, report, fmt.Errorf("reading current entry %d of %d: %w", i, c, err)
 		}
 		n += 16
 
-		s.current[e.K] = e.V
+		if skip(e.V, n-16) {
+			continue
+		}
+
+		current[e.K] = e.V
+		report.CurrentCount++
 	}
 
-	if err := binary.Read(r, binary.BigEndian, &c); err != nil {
-		return n, err
+	if err := binary.Read(cr, binary.BigEndian, &c); err != nil {
+		return n, report, fmt.Errorf("reading history count: %w", err)
 	}
 	n += 8
 
+	history := make(map[uint64]float64)
+
 	for i := uint64(0); i < c; i++ {
 		var e struct {
 			K uint64
 			V float64
 		}
 
-		if err := binary.Read(r, binary.BigEndian, &e); err != nil {
-			return n, err
+		if err := binary.Read(cr, binary.BigEndian, &e); err != nil {
+			return n, report, fmt.Errorf("reading history entry %d of %d: %w", i, c, err)
 		}
 		n += 16
 
-		s.history[e.K] = e.V
+		if skip(e.V, n-16) {
+			continue
+		}
+
+		history[e.K] = e.V
+		report.HistoryCount++
 	}
 
-	if err := binary.Read(r, binary.BigEndian, &c); err != nil {
-		return n, err
+	if err := binary.Read(cr, binary.BigEndian, &c); err != nil {
+		return n, report, fmt.Errorf("reading cleared count: %w", err)
 	}
 	n += 8
 
+	cleared := make(map[uint64]time.Time)
+
 	for i := uint64(0); i < c; i++ {
 		var e struct {
 			K uint64
 			V int64
 		}
 
-		if err := binary.Read(r, binary.BigEndian, &e); err != nil {
-			return n, err
+		if err := binary.Read(cr, binary.BigEndian, &e); err != nil {
+			return n, report, fmt.Errorf("reading cleared entry %d of %d: %w", i, c, err)
 		}
 		n += 16
 
-		s.cleared[e.K] = time.Unix(e.V, 0)
+		if v > versionSeconds {
+			cleared[e.K] = fromUnixNano(e.V)
+		} else {
+			cleared[e.K] = time.Unix(e.V, 0)
+		}
+		report.ClearedCount++
 	}
 
-	return n, nil
+	intervals := make(map[uint64]time.Duration)
+
+	if v > versionNoIntervals {
+		if err := binary.Read(cr, binary.BigEndian, &c); err != nil {
+			return n, report, fmt.Errorf("reading intervals count: %w", err)
+		}
+		n += 8
+
+		for i := uint64(0); i < c; i++ {
+			var e struct {
+				K uint64
+				V int64
+			}
+
+			if err := binary.Read(cr, binary.BigEndian, &e); err != nil {
+				return n, report, fmt.Errorf("reading intervals entry %d of %d: %w", i, c, err)
+			}
+			n += 16
+
+			if e.V > 0 {
+				intervals[e.K] = time.Duration(e.V)
+				report.IntervalCount++
+			}
+		}
+	}
+
+	urls := make(map[uint64]string)
+
+	if v > versionNoURLs {
+		if err := binary.Read(cr, binary.BigEndian, &c); err != nil {
+			return n, report, fmt.Errorf("reading urls count: %w", err)
+		}
+		n += 8
+
+		for i := uint64(0); i < c; i++ {
+			var e struct {
+				K uint64
+				L uint32
+			}
+
+			if err := binary.Read(cr, binary.BigEndian, &e); err != nil {
+				return n, report, fmt.Errorf("reading urls entry %d of %d: %w", i, c, err)
+			}
+			n += 12
+
+			// read through a LimitReader rather than into a buffer of the
+			// stated length, so a corrupt length can't allocate gigabytes
+			d, err := ioutil.ReadAll(io.LimitReader(cr, int64(e.L)))
+			if err == nil && len(d) < int(e.L) {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return n, report, fmt.Errorf("reading urls entry %d of %d: %w", i, c, err)
+			}
+			n += int64(e.L)
+
+			urls[e.K] = string(d)
+			report.URLCount++
+		}
+	}
+
+	if v > versionNoChecksum {
+		sum := h.Sum32()
+
+		var e uint32
+		if err := binary.Read(r, binary.BigEndian, &e); err != nil {
+			return n, report, fmt.Errorf("reading checksum: %w", err)
+		}
+		n += 4
+
+		if e != sum {
+			if o == nil || !o.SkipCorrupt {
+				return n, report, fmt.Errorf("checksum mismatch; expected %08x but got %08x", e, sum)
+			}
+
+			report.ChecksumMismatch = true
+		}
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.unlogged()
+
+	for k, v := range current {
+		s.current[k] = v
+	}
+	for k, v := range history {
+		s.history[k] = v
+	}
+	for k, v := range cleared {
+		s.cleared[k] = v
+	}
+	if len(intervals) > 0 && s.intervals == nil {
+		s.intervals = make(map[uint64]time.Duration, len(intervals))
+	}
+	for k, v := range intervals {
+		s.intervals[k] = v
+	}
+	if s.urls != nil {
+		for k, v := range urls {
+			s.urls[k] = v
+		}
+	}
+
+	if o != nil && o.Reconcile {
+		report.Reconciled = s.reconcile()
+	}
+
+	return n, report, nil
 }
 
-// WriteTo implements io.WriterTo
+// sortedCashKeys returns the keys of m in ascending order.
+func sortedCashKeys(m map[uint64]float64) []uint64 {
+	r := make([]uint64, 0, len(m))
+	for k := range m {
+		r = append(r, k)
+	}
+
+	sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
+
+	return r
+}
+
+// sortedTimeKeys returns the keys of m in ascending order.
+func sortedTimeKeys(m map[uint64]time.Time) []uint64 {
+	r := make([]uint64, 0, len(m))
+	for k := range m {
+		r = append(r, k)
+	}
+
+	sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
+
+	return r
+}
+
+// sortedIntervalKeys returns the keys of m in ascending order.
+func sortedIntervalKeys(m map[uint64]time.Duration) []uint64 {
+	r := make([]uint64, 0, len(m))
+	for k := range m {
+		r = append(r, k)
+	}
+
+	sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
+
+	return r
+}
+
+// sortedURLKeys returns the keys of m in ascending order.
+func sortedURLKeys(m map[uint64]string) []uint64 {
+	r := make([]uint64, 0, len(m))
+	for k := range m {
+		r = append(r, k)
+	}
+
+	sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
+
+	return r
+}
+
+// WriteTo implements io.WriterTo. Each section is written in key order, so
+// the same state always serialises to the same bytes. It writes straight to w
+// as it goes, so it doesn't hold the serialised form in memory, apart from
+// the sorted keys of one section at a time, but it does make many small
+// writes; use WriteToStream when w isn't already buffered.
 func (s *Serialisable) WriteTo(w io.Writer) (int64, error) {
 	s.m.RLock()
 	defer s.m.RUnlock()
 
+	return s.writeTo(w)
+}
+
+// writeTo is the implementation of WriteTo. It must be called with at least
+// the read lock held.
+func (s *Serialisable) writeTo(w io.Writer) (int64, error) {
+	h := crc32.NewIEEE()
+	cw := io.MultiWriter(w, h)
+
 	n := int64(0)
 
-	nw, err := w.Write([]byte(expectedMagic))
+	nw, err := cw.Write([]byte(expectedMagic))
 	if err != nil {
 		return n, err
 	}
 	n += int64(nw)
 
-	if err := binary.Write(w, binary.BigEndian, uint64(1)); err != nil {
+	if err := binary.Write(cw, binary.BigEndian, expectedVersion); err != nil {
 		return n, err
 	}
 	n += 8
 
-	if err := binary.Write(w, binary.BigEndian, uint64(len(s.current))); err != nil {
+	if err := binary.Write(cw, binary.BigEndian, uint64(len(s.current))); err != nil {
 		return n, err
 	}
 	n += 8
 
-	for k, v := range s.current {
-		if err := binary.Write(w, binary.BigEndian, k); err != nil {
+	for _, k := range sortedCashKeys(s.current) {
+		v := s.current[k]
+
+		if err := binary.Write(cw, binary.BigEndian, k); err != nil {
 			return n, err
 		}
 		n += 8
 
-		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+		if err := binary.Write(cw, binary.BigEndian, v); err != nil {
 			return n, err
 		}
 		n += 8
 	}
 
-	if err := binary.Write(w, binary.BigEndian, uint64(len(s.history))); err != nil {
+	if err := binary.Write(cw, binary.BigEndian, uint64(len(s.history))); err != nil {
 		return n, err
 	}
 	n += 8
 
-	for k, v := range s.history {
-		if err := binary.Write(w, binary.BigEndian, k); err != nil {
+	for _, k := range sortedCashKeys(s.history) {
+		v := s.history[k]
+
+		if err := binary.Write(cw, binary.BigEndian, k); err != nil {
 			return n, err
 		}
 		n += 8
 
-		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+		if err := binary.Write(cw, binary.BigEndian, v); err != nil {
 			return n, err
 		}
 		n += 8
 	}
 
-	if err := binary.Write(w, binary.BigEndian, uint64(len(s.cleared))); err != nil {
+	if err := binary.Write(cw, binary.BigEndian, uint64(len(s.cleared))); err != nil {
 		return n, err
 	}
 	n += 8
 
-	for k, v := range s.cleared {
-		if err := binary.Write(w, binary.BigEndian, k); err != nil {
+	for _, k := range sortedTimeKeys(s.cleared) {
+		v := s.cleared[k]
+
+		if err := binary.Write(cw, binary.BigEndian, k); err != nil {
+			return n, err
+		}
+		n += 8
+
+		if err := binary.Write(cw, binary.BigEndian, toUnixNano(v)); err != nil {
+			return n, err
+		}
+		n += 8
+	}
+
+	if err := binary.Write(cw, binary.BigEndian, uint64(len(s.intervals))); err != nil {
+		return n, err
+	}
+	n += 8
+
+	for _, k := range sortedIntervalKeys(s.intervals) {
+		if err := binary.Write(cw, binary.BigEndian, k); err != nil {
+			return n, err
+		}
+		n += 8
+
+		if err := binary.Write(cw, binary.BigEndian, int64(s.intervals[k])); err != nil {
 			return n, err
 		}
 		n += 8
+	}
+
+	if err := binary.Write(cw, binary.BigEndian, uint64(len(s.urls))); err != nil {
+		return n, err
+	}
+	n += 8
 
-		if err := binary.Write(w, binary.BigEndian, v.Unix()); err != nil {
+	for _, k := range sortedURLKeys(s.urls) {
+		v := s.urls[k]
+
+		if err := binary.Write(cw, binary.BigEndian, k); err != nil {
 			return n, err
 		}
 		n += 8
+
+		if err := binary.Write(cw, binary.BigEndian, uint32(len(v))); err != nil {
+			return n, err
+		}
+		n += 4
+
+		nw, err := io.WriteString(cw, v)
+		if err != nil {
+			return n, err
+		}
+		n += int64(nw)
+	}
+
+	if err := binary.Write(w, binary.BigEndian, h.Sum32()); err != nil {
+		return n, err
 	}
+	n += 4
 
 	return n, nil
 }
@@ -190,7 +542,34 @@ func (s *Serialisable) UnmarshalBinary(d []byte) error {
 	return nil
 }
 
-// MarshalBinary implements encoding.BinaryMarshaler
+// WriteToStream is like WriteTo, but buffers the writes to w, flushing when it
+// finishes. Like WriteTo it only needs a small, fixed amount of memory however
+// big the state is, which makes it the right choice for writing large states
+// to files, sockets or compressing writers. The read lock is held until the
+// last write returns, so a slow w holds up writers for as long as it takes.
+func (s *Serialisable) WriteToStream(w io.Writer) (int64, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return s.writeToStream(w)
+}
+
+// writeToStream is the implementation of WriteToStream. It must be called
+// with at least the read lock held.
+func (s *Serialisable) writeToStream(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+
+	n, err := s.writeTo(bw)
+	if err != nil {
+		return n, err
+	}
+
+	return n, bw.Flush()
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. It builds the whole
+// serialised form in memory, which for large states can be several times the
+// size of the state itself; prefer WriteToStream for anything big.
 func (s *Serialisable) MarshalBinary() ([]byte, error) {
 	b := bytes.NewBuffer(nil)
 
@@ -200,3 +579,31 @@ func (s *Serialisable) MarshalBinary() ([]byte, error) {
 
 	return b.Bytes(), nil
 }
+
+// UnmarshalText implements encoding.TextUnmarshaler, decoding the base64
+// form produced by MarshalText.
+func (s *Serialisable) UnmarshalText(d []byte) error {
+	b := make([]byte, base64.StdEncoding.DecodedLen(len(d)))
+
+	n, err := base64.StdEncoding.Decode(b, d)
+	if err != nil {
+		return err
+	}
+
+	return s.UnmarshalBinary(b[:n])
+}
+
+// MarshalText implements encoding.TextMarshaler. It's the binary format,
+// base64 encoded, for embedding small states in config files or environment
+// variables.
+func (s *Serialisable) MarshalText() ([]byte, error) {
+	d, err := s.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, base64.StdEncoding.EncodedLen(len(d)))
+	base64.StdEncoding.Encode(b, d)
+
+	return b, nil
+}
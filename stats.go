@@ -0,0 +1,278 @@
+package opic
+
+import (
+	"math"
+	"sort"
+)
+
+// Gini returns the Gini coefficient of the current cash distribution, from 0
+// (evenly spread) to almost 1 (all cash held by a single entry). A rising
+// value over time suggests something like a spider trap is soaking up cash.
+// The virtual entry is excluded. This sorts a copy of the current values, so
+// it's O(n log n) in the number of entries.
+func (o *OPIC) Gini() float64 {
+	o.m.RLock()
+	v := make([]float64, 0, len(o.current))
+	for k, c := range o.current {
+		if k != 0 {
+			v = append(v, c)
+		}
+	}
+	o.m.RUnlock()
+
+	if len(v) == 0 {
+		return 0
+	}
+
+	sort.Float64s(v)
+
+	var sum, weighted float64
+	for i, c := range v {
+		sum += c
+		weighted += float64(i+1) * c
+	}
+
+	if sum == 0 {
+		return 0
+	}
+
+	n := float64(len(v))
+
+	return (2*weighted)/(n*sum) - (n+1)/n
+}
+
+// VirtualFraction returns the share of the system's current cash that's held
+// by the virtual entry. Cash leaks into the virtual entry on every
+// distribution and only trickles back out to fetched sources, so a value
+// approaching 1 means the frontier is stalled or starved: lots of dead ends,
+// or very few live URLs being fetched.
+func (o *OPIC) VirtualFraction() float64 {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	var sum float64
+	for _, c := range o.current {
+		sum += c
+	}
+
+	if sum == 0 {
+		return 0
+	}
+
+	return o.current[0] / sum
+}
+
+// normalisedCurrent returns the current cash of every entry except the
+// virtual one, scaled to add up to 1. It must be called with at least the
+// read lock held.
+func (o *OPIC) normalisedCurrent() map[uint64]float64 {
+	var sum float64
+	for k, c := range o.current {
+		if k != 0 {
+			sum += c
+		}
+	}
+
+	r := make(map[uint64]float64, len(o.current))
+	for k, c := range o.current {
+		if k != 0 && sum != 0 {
+			r[k] = c / sum
+		}
+	}
+
+	return r
+}
+
+// ConvergenceDelta returns the L1 distance between the normalised current
+// cash of o and of previous, ignoring the virtual entry. Keys missing from
+// either side count as zero. The result ranges from 0 (identical
+// distributions) to 2 (completely disjoint ones), so iterating until it drops
+// below some threshold gives a convergence-based stopping criterion.
+func (o *OPIC) ConvergenceDelta(previous *OPIC) float64 {
+	previous.m.RLock()
+	p := previous.normalisedCurrent()
+	previous.m.RUnlock()
+
+	o.m.RLock()
+	c := o.normalisedCurrent()
+	o.m.RUnlock()
+
+	var d float64
+	for k, v := range c {
+		d += math.Abs(v - p[k])
+	}
+	for k, v := range p {
+		if _, ok := c[k]; !ok {
+			d += math.Abs(v)
+		}
+	}
+
+	return d
+}
+
+// MapStat describes the size of one of the internal maps.
+type MapStat struct {
+	// Len is the number of entries in the map.
+	Len int
+	// Cap is an estimate of how many entries the map has room for.
+	Cap int
+}
+
+// MapStats describes the sizes of the internal maps.
+type MapStats struct {
+	Current, History, Cleared MapStat
+}
+
+// MapStats reports the size of each of the internal maps. Go doesn't expose
+// the capacity of a map, but a map never gives back memory as entries are
+// deleted, so Cap is the largest Len the map has had since it was created.
+// That makes it an approximation: the real allocation is rounded up to the
+// map's internal bucket size. A Cap much larger than Len means memory is
+// being held for entries that are long gone.
+func (o *OPIC) MapStats() MapStats {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	stat := func(l, peak int) MapStat {
+		if peak < l {
+			peak = l
+		}
+
+		return MapStat{Len: l, Cap: peak}
+	}
+
+	return MapStats{
+		Current: stat(len(o.current), o.currentPeak),
+		History: stat(len(o.history), o.historyPeak),
+		Cleared: stat(len(o.cleared), o.clearedPeak),
+	}
+}
+
+// Entropy returns the Shannon entropy, in nats, of the current cash
+// distribution normalised to add up to 1. It's 0 when all the cash is held by
+// a single entry and ln(n) when it's spread evenly over n of them, so falling
+// entropy means the crawl's attention is concentrating on fewer pages. The
+// virtual entry is excluded, as are entries without any cash. It takes a
+// single pass.
+func (o *OPIC) Entropy() float64 {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	return o.entropy()
+}
+
+// entropy is the implementation of Entropy. It must be called with at least
+// the read lock held.
+func (o *OPIC) entropy() float64 {
+	// H = ln(S) - sum(c ln c)/S, which avoids a second pass to normalise
+	var sum, sumCLogC float64
+	for k, c := range o.current {
+		if k == 0 || !(c > 0) {
+			continue
+		}
+
+		sum += c
+		sumCLogC += c * math.Log(c)
+	}
+
+	if sum == 0 {
+		return 0
+	}
+
+	return math.Log(sum) - sumCLogC/sum
+}
+
+// EffectiveURLs returns the perplexity of the current cash distribution,
+// exp(H) where H is the Entropy. It reads as the number of URLs that the
+// crawl's attention is effectively spread over: n if cash is spread evenly
+// over n URLs, approaching 1 if it's all held by one of them. It's 0 if no
+// entry has any cash.
+func (o *OPIC) EffectiveURLs() float64 {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	for k, c := range o.current {
+		if k != 0 && c > 0 {
+			return math.Exp(o.entropy())
+		}
+	}
+
+	return 0
+}
+
+// StatsResult summarises the state of an instance. See Stats.
+type StatsResult struct {
+	// Entries is the number of entries with a current value, not counting the
+	// virtual entry, as reported by Len.
+	Entries int
+	// Current and History are the totals of each, including the virtual
+	// entry, as reported by Sums.
+	Current, History float64
+	// MinCurrent, MaxCurrent and MeanCurrent describe the current cash of
+	// the entries counted by Entries. They're zero if there aren't any.
+	MinCurrent, MaxCurrent, MeanCurrent float64
+	// VirtualCurrent and VirtualHistory are the virtual entry's values.
+	VirtualCurrent, VirtualHistory float64
+}
+
+// Stats returns aggregate statistics about the state, computed in a single
+// scan under the read lock, so they're consistent with each other.
+func (o *OPIC) Stats() StatsResult {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	r := StatsResult{
+		VirtualCurrent: o.current[0],
+		VirtualHistory: o.history[0],
+	}
+
+	for k, c := range o.current {
+		r.Current += c
+
+		if k == 0 {
+			continue
+		}
+
+		if r.Entries == 0 || c < r.MinCurrent {
+			r.MinCurrent = c
+		}
+		if r.Entries == 0 || c > r.MaxCurrent {
+			r.MaxCurrent = c
+		}
+
+		r.Entries++
+	}
+
+	for _, h := range o.history {
+		r.History += h
+	}
+
+	if r.Entries > 0 {
+		r.MeanCurrent = (r.Current - r.VirtualCurrent) / float64(r.Entries)
+	}
+
+	return r
+}
+
+// Histogram counts the entries whose current cash falls in each of the ranges
+// separated by buckets, which must be in ascending order. The result has one
+// more element than buckets: the first counts entries below buckets[0], the
+// last counts entries at or above the final boundary, and in between, element
+// i counts entries at or above buckets[i-1] and below buckets[i]. The virtual
+// entry is excluded.
+func (o *OPIC) Histogram(buckets []float64) []int {
+	r := make([]int, len(buckets)+1)
+
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	for k, c := range o.current {
+		if k == 0 {
+			continue
+		}
+
+		r[sort.Search(len(buckets), func(i int) bool { return buckets[i] > c })]++
+	}
+
+	return r
+}
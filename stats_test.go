@@ -0,0 +1,39 @@
+package opic
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestGiniEntropy(t *testing.T) {
+	for _, tc := range []struct {
+		current []float64
+		gini    float64
+		entropy float64
+	}{
+		{[]float64{1, 1, 1, 1}, 0, math.Log(4)},
+		// sorted 0, 0, 0, 1: 2*(4*1)/(4*1) - 5/4
+		{[]float64{0, 0, 0, 1}, 0.75, 0},
+		// sorted 1, 3: 2*(1*1 + 2*3)/(2*4) - 3/2
+		{[]float64{3, 1}, 0.25, -(0.25*math.Log(0.25) + 0.75*math.Log(0.75))},
+		{nil, 0, 0},
+	} {
+		o := New()
+		for i, c := range tc.current {
+			o.Initialise(c, []string{fmt.Sprintf("%d", i)})
+		}
+
+		// the virtual entry is left out of both
+		o.m.Lock()
+		o.current[0] = 10
+		o.m.Unlock()
+
+		if g := o.Gini(); math.Abs(g-tc.gini) > 1e-12 {
+			t.Errorf("%v: expected a Gini coefficient of %v but got %v", tc.current, tc.gini, g)
+		}
+		if e := o.Entropy(); math.Abs(e-tc.entropy) > 1e-12 {
+			t.Errorf("%v: expected an entropy of %v but got %v", tc.current, tc.entropy, e)
+		}
+	}
+}
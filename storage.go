@@ -0,0 +1,165 @@
+package opic
+
+import (
+	"sync"
+	"time"
+)
+
+// Storage is a key-value store of entries, for keeping a copy of a state
+// somewhere other than the flat files used by Persistent, such as an embedded
+// database. WriteStorage and ReadStorage copy a state to and from a Storage
+// as a whole.
+//
+// A Storage isn't a backend that an instance runs against. Every operation
+// reads and writes the in-memory maps directly under the instance's lock, so
+// the whole state still has to fit in memory, and a crawl that outgrows it
+// has to be sharded across instances (see Merge) instead.
+type Storage interface {
+	// Get returns the entry for a hash, and whether there was one.
+	Get(hash uint64) (Entry, bool, error)
+	// Set stores an entry, replacing any with the same hash.
+	Set(e Entry) error
+	// Delete removes the entry for a hash, if there is one.
+	Delete(hash uint64) error
+	// Iterate calls fn for every entry, in no particular order, stopping
+	// early if fn returns false. fn must not modify the Storage.
+	Iterate(fn func(e Entry) bool) error
+}
+
+// MapStorage is a Storage backed by a map, mostly useful as a reference
+// implementation and for testing. It's safe for concurrent use.
+type MapStorage struct {
+	m       sync.RWMutex
+	entries map[uint64]Entry
+}
+
+// NewMapStorage creates a new, empty MapStorage.
+func NewMapStorage() *MapStorage {
+	return &MapStorage{entries: make(map[uint64]Entry)}
+}
+
+// Get implements Storage.
+func (s *MapStorage) Get(hash uint64) (Entry, bool, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	e, ok := s.entries[hash]
+
+	return e, ok, nil
+}
+
+// Set implements Storage.
+func (s *MapStorage) Set(e Entry) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.entries[e.Hash] = e
+
+	return nil
+}
+
+// Delete implements Storage.
+func (s *MapStorage) Delete(hash uint64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.entries, hash)
+
+	return nil
+}
+
+// Iterate implements Storage.
+func (s *MapStorage) Iterate(fn func(e Entry) bool) error {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	for _, e := range s.entries {
+		if !fn(e) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// WriteStorage makes st hold the same entries as o, including the virtual
+// entry, setting every entry and then deleting any in st that o doesn't
+// have. The read lock is held throughout. An entry missing from some of the
+// internal maps is stored with zero values for them, which reads back the
+// same way Reconcile would fill it in. If it fails part way through, st is
+// left with a mix of old and new entries.
+func (o *OPIC) WriteStorage(st Storage) error {
+	o.m.RLock()
+	defer o.m.RUnlock()
+
+	for _, k := range o.sortedKeys() {
+		if err := st.Set(o.entry(k)); err != nil {
+			return err
+		}
+	}
+
+	var stale []uint64
+	if err := st.Iterate(func(e Entry) bool {
+		_, cok := o.current[e.Hash]
+		_, hok := o.history[e.Hash]
+		_, tok := o.cleared[e.Hash]
+		_, iok := o.intervals[e.Hash]
+		if !cok && !hok && !tok && !iok {
+			stale = append(stale, e.Hash)
+		}
+
+		return true
+	}); err != nil {
+		return err
+	}
+
+	for _, k := range stale {
+		if err := st.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadStorage reads every entry in st into o. Like ReadFrom, the entries are
+// added to the existing state, replacing any with the same keys, and nothing
+// is changed if st can't be read in full. Unlike ReadFrom, which is usually
+// loading the file a Persistent instance saves to, the entries read aren't
+// in that file yet, so the state is marked dirty.
+func (o *OPIC) ReadStorage(st Storage) error {
+	var in []Entry
+	if err := st.Iterate(func(e Entry) bool {
+		in = append(in, e)
+		return true
+	}); err != nil {
+		return err
+	}
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if len(in) > 0 {
+		o.changed()
+	}
+
+	for _, e := range in {
+		o.current[e.Hash] = e.Current
+		o.history[e.Hash] = e.History
+		if !e.Cleared.IsZero() {
+			o.cleared[e.Hash] = e.Cleared
+		} else {
+			delete(o.cleared, e.Hash)
+		}
+		if e.Interval > 0 {
+			if o.intervals == nil {
+				o.intervals = make(map[uint64]time.Duration)
+			}
+			o.intervals[e.Hash] = e.Interval
+		} else {
+			delete(o.intervals, e.Hash)
+		}
+	}
+
+	return nil
+}
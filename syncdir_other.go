@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package opic
+
+// syncDir does nothing on this platform, where directories can't be opened
+// for syncing. The rename in Save is still atomic, but may not be durable.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package opic
+
+import (
+	"os"
+)
+
+// syncDir flushes a directory to disk, so that a rename into it survives a
+// crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return err
+	}
+
+	return d.Close()
+}
@@ -0,0 +1,43 @@
+package opic
+
+import (
+	"math/rand"
+	"time"
+)
+
+// GenerateSynthetic builds an OPIC instance with n entries filled with
+// pseudorandom values derived from seed, so the same arguments always give
+// the same state. It's intended for tests, benchmarks, and experimentation;
+// the values don't represent a meaningful crawl. Current cash (including a
+// share held by the virtual entry) adds up to 1, and cleared times fall
+// within a year of the start of 2015.
+func GenerateSynthetic(n int, seed int64) *OPIC {
+	rng := rand.New(rand.NewSource(seed))
+
+	o := New()
+
+	base := time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+	year := int64(365 * 24 * time.Hour)
+
+	o.current[0] = rng.Float64()
+	sum := o.current[0]
+
+	for len(o.current) < n+1 {
+		k := rng.Uint64()
+		if _, ok := o.current[k]; ok || k == 0 {
+			continue
+		}
+
+		o.current[k] = rng.Float64()
+		o.history[k] = rng.Float64()
+		o.cleared[k] = base.Add(time.Duration(rng.Int63n(year)))
+
+		sum += o.current[k]
+	}
+
+	for k, c := range o.current {
+		o.current[k] = c / sum
+	}
+
+	return o
+}
@@ -0,0 +1,243 @@
+package opic
+
+import (
+	"time"
+)
+
+// Tx gives access to an OPIC instance inside Transaction. Its methods behave
+// like the OPIC methods of the same name.
+type Tx struct {
+	o *OPIC
+
+	// every entry touched so far, as it was before the transaction
+	saved map[uint64]txEntry
+
+	dirty      bool
+	recent     []uint64
+	recentNext int
+	recentLen  int
+	collisions int
+
+	// the write-ahead log hooks, which are held back until commit
+	onDistribute func(source uint64, out []uint64, weights []float64, fraction float64, t time.Time)
+	onUnlogged   func()
+	logged       []func()
+}
+
+// txEntry is an entry as it was before a transaction touched it.
+type txEntry struct {
+	c             float64
+	h             float64
+	t             time.Time
+	i             time.Duration
+	u             string
+	cok, hok, tok bool
+	iok, uok      bool
+}
+
+// Transaction runs fn with the write lock held, so that everything done
+// through tx becomes visible to readers at once, and no other operation can
+// interleave with it. It's all or nothing: if fn returns an error or panics,
+// every change made through tx is undone before the error is returned or the
+// panic carries on. Events and write-ahead log records are held back until
+// fn has returned successfully, so subscribers and the log never see changes
+// that were undone. fn must only use tx, and not call methods on the OPIC
+// instance itself, or it will deadlock. tx must not be used after fn returns.
+func (o *OPIC) Transaction(fn func(tx *Tx) error) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	tx := o.begin()
+	defer func() { tx.o = nil }()
+
+	var committed bool
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	tx.commit()
+	committed = true
+
+	return nil
+}
+
+// begin starts a transaction. It must be called with the write lock held.
+func (o *OPIC) begin() *Tx {
+	tx := &Tx{
+		o:            o,
+		saved:        make(map[uint64]txEntry),
+		dirty:        o.dirty,
+		recent:       append([]uint64(nil), o.recent...),
+		recentNext:   o.recentNext,
+		recentLen:    o.recentLen,
+		collisions:   len(o.collisions),
+		onDistribute: o.onDistribute,
+		onUnlogged:   o.onUnlogged,
+	}
+
+	if tx.onDistribute != nil {
+		o.onDistribute = func(source uint64, out []uint64, weights []float64, fraction float64, t time.Time) {
+			tx.logged = append(tx.logged, func() { tx.onDistribute(source, out, weights, fraction, t) })
+		}
+	}
+	if tx.onUnlogged != nil {
+		o.onUnlogged = func() {
+			tx.logged = append(tx.logged, tx.onUnlogged)
+		}
+	}
+
+	o.holding = true
+
+	return tx
+}
+
+// end puts back what begin replaced, returning the events held back in the
+// meantime.
+func (tx *Tx) end() []Event {
+	o := tx.o
+
+	o.onDistribute, o.onUnlogged = tx.onDistribute, tx.onUnlogged
+
+	held := o.held
+	o.holding, o.held = false, nil
+
+	return held
+}
+
+// commit lets the log and subscribers know about everything done in the
+// transaction, in the order it was done.
+func (tx *Tx) commit() {
+	held := tx.end()
+
+	for _, fn := range tx.logged {
+		fn()
+	}
+
+	for _, e := range held {
+		tx.o.emit(e.Kind, e.Key, e.Amount)
+	}
+}
+
+// rollback undoes everything done in the transaction.
+func (tx *Tx) rollback() {
+	tx.end()
+
+	o := tx.o
+
+	for k, e := range tx.saved {
+		if e.cok {
+			o.current[k] = e.c
+		} else {
+			delete(o.current, k)
+		}
+		if e.hok {
+			o.history[k] = e.h
+		} else {
+			delete(o.history, k)
+		}
+		if e.tok {
+			o.cleared[k] = e.t
+		} else {
+			delete(o.cleared, k)
+		}
+		if e.iok {
+			o.intervals[k] = e.i
+		} else {
+			delete(o.intervals, k)
+		}
+		if e.uok {
+			o.urls[k] = e.u
+		} else {
+			delete(o.urls, k)
+		}
+	}
+
+	o.dirty = tx.dirty
+	copy(o.recent, tx.recent)
+	o.recentNext, o.recentLen = tx.recentNext, tx.recentLen
+	o.collisions = o.collisions[:tx.collisions]
+}
+
+// save remembers the entries for keys as they were before the transaction,
+// unless they've already been touched.
+func (tx *Tx) save(keys ...uint64) {
+	o := tx.o
+
+	for _, k := range keys {
+		if _, ok := tx.saved[k]; ok {
+			continue
+		}
+
+		var e txEntry
+		e.c, e.cok = o.current[k]
+		e.h, e.hok = o.history[k]
+		e.t, e.tok = o.cleared[k]
+		e.i, e.iok = o.intervals[k]
+		e.u, e.uok = o.urls[k]
+
+		tx.saved[k] = e
+	}
+}
+
+// Get gets the details for an entry.
+func (tx *Tx) Get(s string) (float64, float64, time.Time) {
+	v := tx.o.hash(s)
+
+	return tx.o.history[v], tx.o.current[v], tx.o.cleared[v]
+}
+
+// Estimate estimates the total for an entry.
+func (tx *Tx) Estimate(s string, interval time.Duration, t time.Time) float64 {
+	return tx.o.estimate(tx.o.hash(s), interval, t)
+}
+
+// Initialise distributes cash evenly amongst a collection of URLs.
+func (tx *Tx) Initialise(cash float64, in []string) {
+	ids := tx.o.hashList(in)
+
+	tx.save(ids...)
+
+	tx.o.noteURLs(in, ids)
+	tx.o.initialise(cash, ids)
+}
+
+// Distribute distributes the cash from the input to the outputs, and marks
+// the input as having been fetched.
+func (tx *Tx) Distribute(source string, out []string, t time.Time) float64 {
+	sourceH, outH := tx.o.hashAll(source, out)
+
+	tx.save(0, sourceH)
+	tx.save(outH...)
+
+	tx.o.noteURL(sourceH, source)
+	tx.o.noteURLs(out, outH)
+
+	return tx.o.distribute(sourceH, outH, t)
+}
+
+// Finalise moves all the current values into the history for the inputs.
+func (tx *Tx) Finalise(in []string) {
+	ids := tx.o.hashList(in)
+
+	tx.save(ids...)
+
+	tx.o.finalise(ids)
+}
+
+// Remove deletes an entry entirely, moving its cash to the virtual entry.
+func (tx *Tx) Remove(s string) float64 {
+	v := tx.o.hash(s)
+	if v == 0 {
+		return 0
+	}
+
+	tx.save(0, v)
+
+	return tx.o.remove(v)
+}
@@ -0,0 +1,87 @@
+package opic
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTransactionRollback(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	o := New()
+	o.SetTrackURLs(true)
+	o.SetRecentSources(2)
+	o.Initialise(1, []string{"a", "b", "c"})
+	o.Distribute("a", []string{"b"}, t0)
+
+	o.dirty = false
+
+	expected := o.ContentHash()
+	recent := o.RecentSources(2)
+
+	events, unsubscribe := o.Subscribe()
+	defer unsubscribe()
+
+	changes := func(tx *Tx) {
+		tx.Initialise(1, []string{"d", "e"})
+		tx.Distribute("b", []string{"c", "d", "new"}, t0.Add(time.Hour))
+		tx.Finalise([]string{"c"})
+		tx.Remove("a")
+	}
+
+	failed := errors.New("failed")
+	if err := o.Transaction(func(tx *Tx) error {
+		changes(tx)
+		return failed
+	}); err != failed {
+		t.Errorf("expected the error from fn to be returned, got %v", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected the panic to carry on")
+			}
+		}()
+
+		o.Transaction(func(tx *Tx) error {
+			changes(tx)
+			panic("failed")
+		})
+	}()
+
+	if o.ContentHash() != expected {
+		t.Errorf("expected the state to be unchanged")
+	}
+	if o.Dirty() {
+		t.Errorf("expected the state to still be clean")
+	}
+	if r := o.RecentSources(2); len(r) != len(recent) || r[0] != recent[0] {
+		t.Errorf("expected recent sources %v but got %v", recent, r)
+	}
+	if _, ok := o.URL(o.hash("new")); ok {
+		t.Errorf("expected the new URL to be forgotten")
+	}
+	if len(events) != 0 {
+		t.Errorf("expected no events but got %d", len(events))
+	}
+
+	// and the same changes stick once fn succeeds
+	if err := o.Transaction(func(tx *Tx) error {
+		changes(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if o.ContentHash() == expected {
+		t.Errorf("expected the state to have changed")
+	}
+	if _, c, _ := o.Get("new"); c == 0 {
+		t.Errorf("expected the new URL to have been given cash")
+	}
+	if len(events) == 0 {
+		t.Errorf("expected events once the transaction committed")
+	}
+}
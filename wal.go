@@ -0,0 +1,294 @@
+package opic
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// Each distribution is logged as a single record, all big endian:
+//
+//	uint32   length of the rest of the record, not counting the checksum
+//	int64    time, in Unix nanoseconds, or zeroUnixNano
+//	uint64   source
+//	uint32   number of outputs, n
+//	uint8    flags: walWeighted if there are weights, walPartial if it's
+//	         from DistributePartial
+//	n×uint64 outputs
+//	n×float64 weights, if there are any
+//	float64  fraction, if it's partial
+//	uint32   CRC32 of everything before it in the record
+//
+// A record that's cut short or fails its checksum marks the end of the log,
+// since it can only be the result of a crash part way through writing it.
+const (
+	walHeader = 4 + 8 + 8 + 4 + 1
+	walMax    = 1 << 30
+
+	walWeighted = 1
+	walPartial  = 2
+)
+
+// ErrUnlogged is the error reported by WALError once the state has been
+// changed by something that the write-ahead log can't record.
+var ErrUnlogged = errors.New("state changed by an operation that isn't logged; save to resume logging")
+
+// NewPersistentWAL is like NewPersistent, but also keeps a write-ahead log in
+// walFile, so that distributions made since the last Save can be recovered
+// after a crash. Every distribution is appended to the log as it happens, Load
+// replays the log on top of the state it reads from snapshotFile, and Save
+// empties the log once the new state is in place. Load must be called before
+// anything else is done with the instance, or the log won't match the state.
+//
+// Only distributions are logged, including partial ones. Anything else that
+// changes the state, like Initialise or Finalise, stops logging until the
+// next successful Save, since distributions logged after it would be replayed
+// against a state that doesn't include it; WALError then returns
+// ErrUnlogged. A crash before that Save recovers the state as it was just
+// before the change, so one should follow any such change promptly. Settings
+// that affect distributions, like SetMinShare and SetSkipDegenerate, must be
+// the same when Load replays the log as they were when it was written.
+//
+// Records are handed to the operating system as they're written, so they
+// survive the process crashing, but aren't synced to disk, so a power failure
+// can lose the last few of them. Save holds the read lock from when it starts
+// writing the state until the log has been emptied, so distributions wait
+// for the whole of a Save rather than just the writing. If a record can't be
+// written, logging stops until the next successful Save; see WALError.
+func NewPersistentWAL(snapshotFile, walFile string) *Persistent {
+	return NewPersistentWALWithHash(snapshotFile, walFile, fnvHash)
+}
+
+// NewPersistentWALWithHash is like NewPersistentWAL, but uses h to hash URLs.
+// See NewPersistentWithHash.
+func NewPersistentWALWithHash(snapshotFile, walFile string, h HashFunc) *Persistent {
+	p := NewPersistentWithHash(snapshotFile, h)
+	p.walFile = walFile
+	p.onDistribute = p.logDistribute
+	p.onUnlogged = p.stopWAL
+
+	return p
+}
+
+// WALError returns the error that stopped the write-ahead log being written,
+// if there was one since the last successful Save. Distributions made since
+// then are still in memory, but won't be recovered after a crash.
+func (p *Persistent) WALError() error {
+	p.walM.Lock()
+	defer p.walM.Unlock()
+
+	return p.walErr
+}
+
+// stopWAL stops logging until the next successful Save, because the state
+// has changed in a way that can't be logged. It's called with the write lock
+// held.
+func (p *Persistent) stopWAL() {
+	p.walM.Lock()
+	defer p.walM.Unlock()
+
+	if p.walErr == nil {
+		p.walErr = ErrUnlogged
+	}
+}
+
+// logDistribute appends a record to the log. It's called with the write lock
+// held.
+func (p *Persistent) logDistribute(source uint64, out []uint64, weights []float64, fraction float64, t time.Time) {
+	p.walM.Lock()
+	defer p.walM.Unlock()
+
+	if p.walErr != nil {
+		return
+	}
+
+	if p.wal == nil {
+		f, err := os.OpenFile(p.walFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			p.walErr = err
+			return
+		}
+
+		p.wal = f
+	}
+
+	partial := fraction != 1
+
+	size := walHeader + 8*len(out)
+	if weights != nil {
+		size += 8 * len(weights)
+	}
+	if partial {
+		size += 8
+	}
+
+	b := make([]byte, size+4)
+
+	binary.BigEndian.PutUint32(b[0:], uint32(size-4))
+	binary.BigEndian.PutUint64(b[4:], uint64(toUnixNano(t)))
+	binary.BigEndian.PutUint64(b[12:], source)
+	binary.BigEndian.PutUint32(b[20:], uint32(len(out)))
+	if weights != nil {
+		b[24] |= walWeighted
+	}
+	if partial {
+		b[24] |= walPartial
+	}
+
+	i := walHeader
+	for _, k := range out {
+		binary.BigEndian.PutUint64(b[i:], k)
+		i += 8
+	}
+	for _, w := range weights {
+		binary.BigEndian.PutUint64(b[i:], math.Float64bits(w))
+		i += 8
+	}
+	if partial {
+		binary.BigEndian.PutUint64(b[i:], math.Float64bits(fraction))
+		i += 8
+	}
+
+	binary.BigEndian.PutUint32(b[i:], crc32.ChecksumIEEE(b[:i]))
+
+	if _, err := p.wal.Write(b); err != nil {
+		p.walErr = err
+	}
+}
+
+// replayWAL applies every complete record in the log, returning how many there
+// were, and cuts off anything after them so that new records follow on from
+// the last good one.
+func (p *Persistent) replayWAL() (int, error) {
+	f, err := os.Open(p.walFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+	defer f.Close()
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	r := bufio.NewReader(f)
+
+	var n int
+	var good int64
+	for {
+		var l [4]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+
+			return n, err
+		}
+
+		size := int(binary.BigEndian.Uint32(l[:])) + 4
+		if size < walHeader || size > walMax {
+			break
+		}
+
+		b := make([]byte, size+4)
+		copy(b, l[:])
+		if _, err := io.ReadFull(r, b[4:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+
+			return n, err
+		}
+
+		if crc32.ChecksumIEEE(b[:size]) != binary.BigEndian.Uint32(b[size:]) {
+			break
+		}
+
+		count := int(binary.BigEndian.Uint32(b[20:]))
+		flags := b[24]
+		weighted, partial := flags&walWeighted != 0, flags&walPartial != 0
+
+		if flags&^(walWeighted|walPartial) != 0 || (weighted && partial) {
+			return n, fmt.Errorf("record at offset %d has invalid flags %02x", good, flags)
+		}
+
+		want := walHeader + 8*count
+		if weighted {
+			want += 8 * count
+		}
+		if partial {
+			want += 8
+		}
+		if want != size {
+			return n, fmt.Errorf("record at offset %d has %d outputs but is %d bytes long", good, count, size)
+		}
+
+		t := fromUnixNano(int64(binary.BigEndian.Uint64(b[4:])))
+
+		source := binary.BigEndian.Uint64(b[12:])
+
+		out := make([]uint64, count)
+		i := walHeader
+		for j := range out {
+			out[j] = binary.BigEndian.Uint64(b[i:])
+			i += 8
+		}
+
+		var weights []float64
+		if weighted {
+			weights = make([]float64, count)
+			for j := range weights {
+				weights[j] = math.Float64frombits(binary.BigEndian.Uint64(b[i:]))
+				i += 8
+			}
+		}
+
+		if partial {
+			p.distributePartial(source, out, math.Float64frombits(binary.BigEndian.Uint64(b[i:])), t)
+		} else {
+			p.distributeWeighted(source, out, weights, t)
+		}
+
+		n++
+		good += int64(len(b))
+	}
+
+	if fi, err := f.Stat(); err == nil && fi.Size() > good {
+		if err := os.Truncate(p.walFile, good); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// truncateWAL empties the log, and clears any error that stopped it being
+// written, since everything it would have held is now in the saved state. It
+// must be called with at least the read lock held, so that nothing can be
+// logged between the state being written and the log being emptied.
+func (p *Persistent) truncateWAL() error {
+	p.walM.Lock()
+	defer p.walM.Unlock()
+
+	var err error
+	if p.wal != nil {
+		err = p.wal.Truncate(0)
+	} else if err = os.Truncate(p.walFile, 0); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	p.walErr = nil
+
+	return nil
+}
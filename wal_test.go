@@ -0,0 +1,248 @@
+package opic
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestWAL(t *testing.T) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "opic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "state.opic"), filepath.Join(dir, "state.wal"), func() { os.RemoveAll(dir) }
+}
+
+// reloadWAL loads the files as a process starting up after a crash would.
+func reloadWAL(t *testing.T, state, wal string) *Persistent {
+	t.Helper()
+
+	p := NewPersistentWAL(state, wal)
+	if err := p.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestWALReplay(t *testing.T) {
+	state, wal, cleanup := newTestWAL(t)
+	defer cleanup()
+
+	p := NewPersistentWAL(state, wal)
+	if err := p.Load(&PersistentLoadOptions{IgnoreMissing: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Initialise(1, []string{"a", "b", "c", "d"})
+	if err := p.Save(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.Distribute("a", []string{"b", "c"}, t0)
+	if _, err := p.DistributeWeighted("b", []string{"c", "d"}, []float64{1, 3}, t0.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	p.DistributePartial("c", []string{"a", "d"}, 0.25, t0.Add(time.Second*2))
+	p.DistributeMulti([]DistributeOp{{Source: "d", Out: []string{"a"}}, {Source: "a"}}, t0.Add(time.Second*3))
+
+	if err := p.WALError(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := p.ContentHash()
+
+	// the process dies without saving
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q := reloadWAL(t, state, wal)
+	if q.ContentHash() != expected {
+		t.Errorf("replayed state doesn't match the state before the crash")
+	}
+	if !q.Dirty() {
+		t.Errorf("expected the replayed state to be dirty")
+	}
+
+	// a record cut short by the crash is dropped, along with nothing else
+	f, err := os.OpenFile(wal, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 40, 1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	q = reloadWAL(t, state, wal)
+	if q.ContentHash() != expected {
+		t.Errorf("replayed state with a torn record doesn't match the state before the crash")
+	}
+
+	// and everything is in the state file once it's been saved
+	if err := q.Save(nil); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(wal); err != nil || fi.Size() != 0 {
+		t.Errorf("expected the log to be emptied by Save, got %v", err)
+	}
+
+	if r := reloadWAL(t, state, wal); r.ContentHash() != expected {
+		t.Errorf("saved state doesn't match the state before the crash")
+	}
+}
+
+func TestWALUnlogged(t *testing.T) {
+	state, wal, cleanup := newTestWAL(t)
+	defer cleanup()
+
+	p := NewPersistentWAL(state, wal)
+	if err := p.Load(&PersistentLoadOptions{IgnoreMissing: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Initialise(1, []string{"a", "b", "c"})
+	if err := p.Save(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.Distribute("a", []string{"b", "c"}, t0)
+
+	expected := p.ContentHash()
+
+	// finalising can't be logged, so the distribution after it mustn't be
+	// replayed on top of a state that wasn't finalised
+	p.Finalise([]string{"b"})
+	if err := p.WALError(); err != ErrUnlogged {
+		t.Fatalf("expected %v but got %v", ErrUnlogged, err)
+	}
+	p.Distribute("b", []string{"a"}, t0.Add(time.Second))
+
+	if q := reloadWAL(t, state, wal); q.ContentHash() != expected {
+		t.Errorf("replayed state doesn't match the state before the unlogged change")
+	}
+
+	// saving resumes logging
+	if err := p.Save(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WALError(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Distribute("c", []string{"a"}, t0.Add(time.Second*2))
+
+	if q := reloadWAL(t, state, wal); q.ContentHash() != p.ContentHash() {
+		t.Errorf("replayed state doesn't match the state after logging resumed")
+	}
+}
+
+func TestWALWithHash(t *testing.T) {
+	state, wal, cleanup := newTestWAL(t)
+	defer cleanup()
+
+	h := func(s string) uint64 { return uint64(len(s)) }
+
+	p := NewPersistentWALWithHash(state, wal, h)
+	if err := p.Load(&PersistentLoadOptions{IgnoreMissing: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Initialise(1, []string{"a", "bb", "ccc"})
+	if err := p.Save(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Distribute("a", []string{"bb", "ccc"}, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	q := NewPersistentWALWithHash(state, wal, h)
+	if err := q.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if q.ContentHash() != p.ContentHash() {
+		t.Errorf("replayed state doesn't match the state before the crash")
+	}
+	if _, c, _ := q.GetN(3); c == 0 {
+		t.Errorf("expected the entry to be keyed by the custom hash")
+	}
+}
+
+func TestWALNoopChanges(t *testing.T) {
+	state, wal, cleanup := newTestWAL(t)
+	defer cleanup()
+
+	p := NewPersistentWAL(state, wal)
+	if err := p.Load(&PersistentLoadOptions{IgnoreMissing: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Initialise(1, []string{"a", "b", "c"})
+	if err := p.Save(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// none of these change anything, so logging mustn't stop because of them
+	p.EnsureBalance(0)
+	p.Decay(1)
+	p.FinaliseAt(nil, t0)
+	p.Merge(New(), nil)
+
+	if err := p.WALError(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Dirty() {
+		t.Errorf("expected the state to still be clean")
+	}
+
+	p.Distribute("a", []string{"b", "c"}, t0)
+
+	if q := reloadWAL(t, state, wal); q.ContentHash() != p.ContentHash() {
+		t.Errorf("replayed state doesn't match the state before the crash")
+	}
+}
+
+func TestWALTransaction(t *testing.T) {
+	state, wal, cleanup := newTestWAL(t)
+	defer cleanup()
+
+	p := NewPersistentWAL(state, wal)
+	if err := p.Load(&PersistentLoadOptions{IgnoreMissing: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Initialise(1, []string{"a", "b", "c"})
+	if err := p.Save(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// a distribution that's undone mustn't be replayed
+	p.Transaction(func(tx *Tx) error {
+		tx.Distribute("a", []string{"b", "c"}, t0)
+		return errors.New("failed")
+	})
+	p.Transaction(func(tx *Tx) error {
+		tx.Distribute("b", []string{"a"}, t0.Add(time.Second))
+		return nil
+	})
+
+	if err := p.WALError(); err != nil {
+		t.Fatal(err)
+	}
+
+	if q := reloadWAL(t, state, wal); q.ContentHash() != p.ContentHash() {
+		t.Errorf("replayed state doesn't match the state before the crash")
+	}
+}